@@ -1,13 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"runtime"
+	"strings"
 
 	"github.com/AllenDang/cimgui-go/backend"
 	"github.com/AllenDang/cimgui-go/backend/sdlbackend"
 	"github.com/AllenDang/cimgui-go/imgui"
 	"github.com/bvisness/buongiorno/src"
+	"github.com/bvisness/buongiorno/src/packet"
 )
 
 func init() {
@@ -15,6 +19,26 @@ func init() {
 }
 
 func main() {
+	config := src.LiveCaptureConfig()
+	flag.StringVar(&src.CaptureFile, "file", "", "read packets from a .pcap or .pcapng file instead of capturing live")
+	flag.BoolVar(&src.ReplayFiles, "replay", false, "replay capture files at their original pace instead of loading them all at once")
+	flag.BoolVar(&config.UseSocket, "socket", false, "receive mDNS on a multicast UDP socket instead of capturing with libpcap (no root required)")
+	flag.StringVar(&src.MalformedDir, "malformed-dir", src.MalformedDir, "directory to save malformed packet payloads to")
+	interfaces := flag.String("i", "", "comma-separated list of interfaces to capture on (default all)")
+	mode := flag.String("mode", config.Filter.Mode.String(), "which mDNS traffic to capture: multicast, unicast (also unicast responses), or legacy (also legacy unicast queries)")
+	flag.StringVar(&config.Filter.Custom, "bpf", "", "custom BPF filter for the live capture, overriding -mode")
+	flag.Parse()
+	if *interfaces != "" {
+		config.Interfaces = strings.Split(*interfaces, ",")
+	}
+	if m, err := packet.ParseCaptureMode(*mode); err == nil {
+		config.Filter.Mode = m
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	src.SetLiveCaptureConfig(config)
+
 	currentBackend, err := backend.CreateBackend(sdlbackend.NewSDLBackend())
 	if err != nil {
 		panic(err)
@@ -25,7 +49,8 @@ func main() {
 	currentBackend.CreateWindow("Buongiorno", 1200, 900)
 
 	currentBackend.SetDropCallback(func(p []string) {
-		fmt.Printf("drop triggered: %v", p)
+		fmt.Printf("drop triggered: %v\n", p)
+		src.LoadCaptureFiles(p)
 	})
 	currentBackend.SetCloseCallback(func() {
 		fmt.Println("window is closing")
@@ -15,7 +15,7 @@ func main() {
 		panic(err)
 	}
 
-	err = handle.SetBPFFilter("udp port 5353 and (dst host 224.0.0.251 or dst host ff02::fb)")
+	err = handle.SetBPFFilter(dnspacket.CaptureMulticast.BPF())
 	if err != nil {
 		panic(err)
 	}
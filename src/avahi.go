@@ -5,6 +5,8 @@ import (
 	"log"
 	"os/exec"
 	"strings"
+
+	"github.com/bvisness/buongiorno/src/discovery"
 )
 
 type AvahiService struct {
@@ -16,7 +18,8 @@ type AvahiService struct {
 	Hostname    string
 	Address     string
 	Port        string
-	TxtRecords  []string
+	TxtRecords  []string            // the raw strings, still escaped
+	TXT         discovery.TXTRecord // TxtRecords, parsed
 }
 
 func getAvahiServices() <-chan []AvahiService {
@@ -39,7 +42,8 @@ func getAvahiServices() <-chan []AvahiService {
 				continue
 			}
 
-			parts := strings.Split(line, ";")
+			// The TXT record comes last and may itself contain semicolons.
+			parts := strings.SplitN(line, ";", 10)
 			switch parts[0] {
 			case "+":
 				services = append(services, AvahiService{
@@ -68,7 +72,8 @@ func getAvahiServices() <-chan []AvahiService {
 				service.Hostname = parts[6]
 				service.Address = parts[7]
 				service.Port = parts[8]
-				service.TxtRecords = []string{parts[9]} // TODO: Actually split
+				service.TxtRecords = splitAvahiTXT(parts[9])
+				service.TXT = discovery.ParseTXT(service.TxtRecords)
 			default:
 				panic(fmt.Errorf("unknown line type %v", parts[0]))
 			}
@@ -80,6 +85,36 @@ func getAvahiServices() <-chan []AvahiService {
 	return res
 }
 
+// Splits the TXT record as printed by avahi-browse, e.g. "a=1" "b=2", into
+// its strings. Quotes and backslashes inside the strings are escaped with a
+// backslash, as are unprintable bytes (\DDD); the escapes are left for
+// discovery.ParseTXT to undo.
+func splitAvahiTXT(s string) []string {
+	var res []string
+	var current strings.Builder
+	inString := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case !inString:
+			if c == '"' {
+				inString = true
+				current.Reset()
+			}
+		case c == '\\' && i+1 < len(s):
+			current.WriteByte(c)
+			current.WriteByte(s[i+1])
+			i++
+		case c == '"':
+			res = append(res, current.String())
+			inString = false
+		default:
+			current.WriteByte(c)
+		}
+	}
+	return res
+}
+
 type AvahiServiceType struct {
 	DNSSDName string
 	NiceName  string
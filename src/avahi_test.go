@@ -1,6 +1,11 @@
 package src
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/bvisness/buongiorno/src/discovery"
+	"github.com/stretchr/testify/assert"
+)
 
 func TestGetAvahiServiceTypes(t *testing.T) {
 	types := getAvahiServiceTypes()
@@ -8,3 +13,15 @@ func TestGetAvahiServiceTypes(t *testing.T) {
 		t.Logf("%s (%s)", typ.DNSSDName, typ.NiceName)
 	}
 }
+
+func TestSplitAvahiTXT(t *testing.T) {
+	assert.Equal(t,
+		[]string{"model=Mac14,2", `name=say \"hi\"`, "pw", "a;b"},
+		splitAvahiTXT(`"model=Mac14,2" "name=say \"hi\"" "pw" "a;b"`),
+	)
+	assert.Empty(t, splitAvahiTXT(""))
+
+	txt := discovery.ParseTXT(splitAvahiTXT(`"bin=\001x"`))
+	bin, _ := txt.Bytes("bin")
+	assert.Equal(t, []byte{1, 'x'}, bin)
+}
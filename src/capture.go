@@ -0,0 +1,475 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AllenDang/cimgui-go/imgui"
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/bvisness/buongiorno/src/packet/libpcap"
+)
+
+// A CaptureSource is anywhere we get packets from: the live network, or a
+// capture file that was loaded from disk.
+type CaptureSource struct {
+	Name string
+	Live bool
+
+	// Packets from inactive sources are ignored. Sources are deactivated when
+	// a capture file replaces the current view.
+	Active atomic.Bool
+	// Set once the source has no more packets to give, e.g. when we reach the
+	// end of a capture file.
+	Done atomic.Bool
+
+	// How many packets we've processed from this source, by how they were
+	// addressed.
+	MulticastPackets, UnicastPackets atomic.Int64
+}
+
+// Either a packet from a source, a request to reset our state, or a tick of
+// the live capture's clock. These go through the same channel so that they are
+// ordered correctly relative to the packets around them.
+type captureEvent struct {
+	Source *CaptureSource
+	Packet packet.MDNSPacket
+	Reset  bool
+	// For resets, the interfaces being captured on, which our own host is
+	// built from, as of when the reset was asked for.
+	Interfaces []string
+	// Set for ticks. Records from a live capture have to expire even when no
+	// packets are arriving.
+	Expire time.Time
+}
+
+// How the live capture is set up. It is set from the command line and the UI,
+// and read wherever the capture is (re)started or our state is reset, so it is
+// kept behind a lock. See LiveCaptureConfig and SetLiveCaptureConfig.
+type CaptureConfig struct {
+	// The interfaces to capture on. If empty, we capture on all interfaces.
+	Interfaces []string
+	// Which traffic the live capture picks up. See packet.CaptureFilter.
+	Filter packet.CaptureFilter
+	// If set, live packets are received on a multicast UDP socket instead of
+	// captured with libpcap. We also fall back to this if libpcap is
+	// unavailable.
+	UseSocket bool
+}
+
+func LiveCaptureConfig() CaptureConfig {
+	captureConfigMu.Lock()
+	defer captureConfigMu.Unlock()
+	res := captureConfig
+	res.Interfaces = slices.Clone(res.Interfaces)
+	return res
+}
+
+// Changes the configuration used the next time the live capture is started.
+func SetLiveCaptureConfig(config CaptureConfig) {
+	config.Interfaces = slices.Clone(config.Interfaces)
+	captureConfigMu.Lock()
+	defer captureConfigMu.Unlock()
+	captureConfig = config
+}
+
+// How often records from a live capture are checked for expiry.
+const expireInterval = time.Second
+
+var (
+	captureSources []*CaptureSource
+	liveCapture    packet.Source
+
+	// The interfaces available for live capture, and which ones are checked in
+	// the UI.
+	availableInterfaces []packet.Interface
+	selectedInterfaces  = make(map[string]bool)
+	interfacesError     error
+	// Why the live capture last failed to start, if it did.
+	liveCaptureError error
+	// The last custom BPF filter we checked, and what was wrong with it.
+	checkedBPFFilter string
+	bpfFilterError   error
+
+	// If set, dropped capture files are added to the current view instead of
+	// replacing it.
+	mergeDroppedFiles bool
+	// If set, capture files are replayed at their original pace instead of
+	// being loaded all at once.
+	ReplayFiles bool
+
+	captureConfigMu sync.Mutex
+	captureConfig   = CaptureConfig{Filter: packet.CaptureFilter{Mode: packet.CaptureLegacyUnicast}}
+
+	// Packets from every source are funneled into a single goroutine so that
+	// our state is only ever modified by one goroutine.
+	captureEvents = make(chan captureEvent, 1000)
+)
+
+func processPackets() {
+	for ev := range captureEvents {
+		if ev.Reset {
+			resetState(ev.Interfaces)
+		} else if !ev.Expire.IsZero() {
+			if ev.Source.Active.Load() {
+				engine.Expire(ev.Expire)
+			}
+		} else if ev.Source.Active.Load() {
+			if ev.Packet.Multicast {
+				ev.Source.MulticastPackets.Add(1)
+			} else {
+				ev.Source.UnicastPackets.Add(1)
+			}
+			engine.HandlePacket(ev.Packet)
+		}
+	}
+}
+
+func addCaptureSource(source *CaptureSource, packets packet.Source) {
+	captureSources = append(captureSources, source)
+	go collectMalformedPackets(source, packets.Malformed())
+	go func() {
+		for p := range packets.Packets() {
+			if source.Live {
+				recordPacket(p)
+			}
+			captureEvents <- captureEvent{Source: source, Packet: p}
+		}
+		source.Done.Store(true)
+	}()
+}
+
+// Like addCaptureSource, but for a capture file that is being added to other
+// sources. The file's records would be expired by the other sources' newer
+// timestamps straight away, so its timestamps are moved so that it ends now, as
+// if it had just been captured.
+func addMergedCaptureFile(source *CaptureSource, reader packet.Source) {
+	captureSources = append(captureSources, source)
+	go collectMalformedPackets(source, reader.Malformed())
+	go func() {
+		var all []packet.MDNSPacket
+		var end time.Time
+		for p := range reader.Packets() {
+			all = append(all, p)
+			if p.Timestamp.After(end) {
+				end = p.Timestamp
+			}
+		}
+		offset := time.Since(end)
+		for _, p := range all {
+			captureEvents <- captureEvent{Source: source, Packet: p.Shifted(offset)}
+		}
+		source.Done.Store(true)
+	}()
+}
+
+func liveCaptureSource() *CaptureSource {
+	for _, source := range captureSources {
+		if source.Live && !source.Done.Load() {
+			return source
+		}
+	}
+	return nil
+}
+
+// Starts the live capture, or makes it active again if it is still running.
+func startLiveCapture() error {
+	if live := liveCaptureSource(); live != nil {
+		live.Active.Store(true)
+		return nil
+	}
+
+	config := LiveCaptureConfig()
+	capture, kind, err := openLiveCapture(config)
+	if err != nil {
+		return err
+	}
+	addLiveCapture(capture, kind, config)
+	return nil
+}
+
+func addLiveCapture(capture packet.Source, kind string, config CaptureConfig) {
+	liveCapture = capture
+
+	name := fmt.Sprintf("Live capture (%s, %s)", kind, config.Filter)
+	if len(config.Interfaces) > 0 {
+		name = fmt.Sprintf("Live capture (%s on %s, %s)", kind, strings.Join(config.Interfaces, ", "), config.Filter)
+	}
+	source := &CaptureSource{Name: name, Live: true}
+	source.Active.Store(true)
+	addCaptureSource(source, capture)
+
+	go func() {
+		ticker := time.NewTicker(expireInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if source.Done.Load() {
+				return
+			}
+			captureEvents <- captureEvent{Source: source, Expire: now}
+		}
+	}()
+}
+
+// Opens the live capture with libpcap, or with the multicast socket if the user
+// asked for it or libpcap is unavailable. Returns the kind of capture opened.
+func openLiveCapture(config CaptureConfig) (packet.Source, string, error) {
+	if !config.UseSocket {
+		if err := libpcap.ValidateFilter(config.Filter); err != nil {
+			return nil, "", err
+		}
+		capture, err := libpcap.CaptureMDNS(config.Interfaces, config.Filter)
+		if err == nil {
+			return capture, "libpcap", nil
+		}
+		if !errors.Is(err, libpcap.ErrNoPcap) {
+			return nil, "", err
+		}
+		log.Printf("WARNING: Could not start packet capture, falling back to multicast socket: %v", err)
+	}
+
+	if config.Filter.Custom != "" {
+		log.Printf("WARNING: The multicast socket does not support BPF filters; using the %s capture mode instead", config.Filter.Mode)
+	}
+	capture, err := packet.ListenMDNS(config.Interfaces, config.Filter.Mode)
+	if err != nil {
+		return nil, "", err
+	}
+	return capture, "socket", nil
+}
+
+// Switches back to the live capture from capture files, starting it if it
+// isn't running. If it can't be started, the current sources are left alone.
+func returnToLiveCapture() error {
+	if live := liveCaptureSource(); live != nil {
+		deactivateCaptureSources()
+		live.Active.Store(true)
+		return nil
+	}
+
+	config := LiveCaptureConfig()
+	capture, kind, err := openLiveCapture(config)
+	if err != nil {
+		return err
+	}
+	deactivateCaptureSources()
+	addLiveCapture(capture, kind, config)
+	return nil
+}
+
+// Restarts the live capture on a different set of interfaces. This resets our
+// state, since our own host depends on the interfaces. The new capture is
+// opened before the old one is closed, so if it fails, nothing changes.
+func restartLiveCapture(interfaces []string) error {
+	config := LiveCaptureConfig()
+	config.Interfaces = interfaces
+	capture, kind, err := openLiveCapture(config)
+	if err != nil {
+		return err
+	}
+	SetLiveCaptureConfig(config)
+
+	if liveCapture != nil {
+		liveCapture.Close()
+		liveCapture = nil
+	}
+	if live := liveCaptureSource(); live != nil {
+		live.Done.Store(true)
+	}
+	deactivateCaptureSources()
+	addLiveCapture(capture, kind, config)
+	return nil
+}
+
+func refreshInterfaces() {
+	availableInterfaces, interfacesError = libpcap.ListInterfaces()
+	clear(selectedInterfaces)
+	for _, name := range LiveCaptureConfig().Interfaces {
+		selectedInterfaces[name] = true
+	}
+}
+
+// Loads packets from .pcap or .pcapng files, e.g. ones dropped onto the
+// window. Unless mergeDroppedFiles is set, this throws away our current state
+// and stops listening to all other sources, so that the files are viewed on
+// their own. When replaying, files that are loaded together are merged into a
+// single replay, in timestamp order.
+func LoadCaptureFiles(filenames []string) {
+	var names []string
+	var readers []packet.Source
+	for _, filename := range filenames {
+		reader, err := packet.ReadMDNSFile(filename)
+		if err != nil {
+			log.Printf("ERROR: Failed to load capture file: %v", err)
+			continue
+		}
+		names = append(names, filename)
+		readers = append(readers, reader)
+	}
+	if len(readers) == 0 {
+		return
+	}
+
+	merging := mergeDroppedFiles && slices.ContainsFunc(captureSources, func(s *CaptureSource) bool { return s.Active.Load() })
+	if !mergeDroppedFiles {
+		deactivateCaptureSources()
+	}
+
+	if ReplayFiles {
+		if currentReplay != nil {
+			currentReplay.Stop()
+		}
+		var bases []string
+		for _, name := range names {
+			bases = append(bases, filepath.Base(name))
+		}
+		source := &CaptureSource{Name: strings.Join(bases, " + ")}
+		source.Active.Store(true)
+		captureSources = append(captureSources, source)
+		currentReplay = NewReplay(source, merging, readers...)
+		return
+	}
+
+	for i, reader := range readers {
+		source := &CaptureSource{Name: names[i]}
+		source.Active.Store(true)
+		if merging || len(readers) > 1 {
+			addMergedCaptureFile(source, reader)
+		} else {
+			addCaptureSource(source, reader)
+		}
+	}
+}
+
+func deactivateCaptureSources() {
+	for _, source := range captureSources {
+		source.Active.Store(false)
+	}
+	if currentReplay != nil {
+		currentReplay.Stop()
+		currentReplay = nil
+	}
+	captureEvents <- captureEvent{Reset: true, Interfaces: LiveCaptureConfig().Interfaces}
+}
+
+func captureUI() {
+	if imgui.Begin("Capture") {
+		imgui.Checkbox("Merge dropped files into current view", &mergeDroppedFiles)
+		imgui.SetItemTooltip("Drop .pcap or .pcapng files onto the window to load them.")
+		imgui.Checkbox("Replay dropped files in real time", &ReplayFiles)
+
+		imgui.Text("Sources:")
+		for _, source := range captureSources {
+			if !source.Active.Load() {
+				continue
+			}
+			status := ""
+			if source.Done.Load() {
+				status = " (done)"
+			}
+			imgui.BulletText(fmt.Sprintf("%s%s", filepath.Base(source.Name), status))
+			imgui.SetItemTooltip(fmt.Sprintf("%d multicast packets\n%d unicast packets",
+				source.MulticastPackets.Load(), source.UnicastPackets.Load(),
+			))
+		}
+
+		if currentReplay != nil {
+			imgui.Separator()
+			currentReplay.UI()
+		}
+
+		if liveCaptureSource() != nil {
+			imgui.Separator()
+			recordUI()
+		}
+
+		imgui.Separator()
+		if liveCaptureError != nil {
+			imgui.Text(fmt.Sprintf("Could not start packet capture: %v", liveCaptureError))
+		}
+		interfacesUI()
+
+		if live := liveCaptureSource(); live == nil || !live.Active.Load() {
+			if imgui.Button("Return to live capture") {
+				liveCaptureError = returnToLiveCapture()
+			}
+		}
+	}
+	imgui.End()
+}
+
+func interfacesUI() {
+	if !imgui.TreeNodeExStrStr("interfaces", 0, "Interfaces") {
+		return
+	}
+	defer imgui.TreePop()
+
+	if availableInterfaces == nil && interfacesError == nil {
+		refreshInterfaces()
+	}
+	if interfacesError != nil {
+		imgui.Text(fmt.Sprintf("Could not list interfaces: %v", interfacesError))
+	}
+
+	for _, intf := range availableInterfaces {
+		selected := selectedInterfaces[intf.Name]
+		if imgui.Checkbox(intf.Name, &selected) {
+			selectedInterfaces[intf.Name] = selected
+		}
+		var addrs []string
+		for _, addr := range intf.Addrs {
+			addrs = append(addrs, addr.String())
+		}
+		tooltip := strings.Join(append([]string{intf.Description}, addrs...), "\n")
+		imgui.SetItemTooltip(strings.TrimSpace(tooltip))
+	}
+
+	// Edit a copy of the configuration, and store it if anything changed.
+	config := LiveCaptureConfig()
+	changed := false
+	if imgui.BeginCombo("Capture mode", config.Filter.Mode.Description()) {
+		for _, mode := range packet.CaptureModes {
+			if imgui.SelectableBoolV(mode.Description(), mode == config.Filter.Mode, 0, imgui.NewVec2(0, 0)) {
+				config.Filter.Mode = mode
+				changed = true
+			}
+		}
+		imgui.EndCombo()
+	}
+	changed = imgui.InputTextWithHint("BPF filter", config.Filter.Mode.BPF(), &config.Filter.Custom, 0, nil) || changed
+	imgui.SetItemTooltip("Overrides the capture mode. Not supported by the multicast socket.")
+	if config.Filter.Custom != checkedBPFFilter {
+		checkedBPFFilter = config.Filter.Custom
+		bpfFilterError = libpcap.ValidateFilter(config.Filter)
+	}
+	if bpfFilterError != nil {
+		imgui.Text(bpfFilterError.Error())
+	}
+
+	changed = imgui.Checkbox("Use multicast socket", &config.UseSocket) || changed
+	imgui.SetItemTooltip("Receives mDNS on an ordinary UDP socket, which needs no special privileges,\nbut only sees multicast traffic and has no link-layer data.")
+	if changed {
+		SetLiveCaptureConfig(config)
+	}
+
+	if imgui.Button("Refresh") {
+		refreshInterfaces()
+	}
+	imgui.SameLine()
+	if imgui.Button("Restart capture") {
+		var interfaces []string
+		for _, intf := range availableInterfaces {
+			if selectedInterfaces[intf.Name] {
+				interfaces = append(interfaces, intf.Name)
+			}
+		}
+		liveCaptureError = restartLiveCapture(interfaces)
+	}
+	imgui.SetItemTooltip("Captures on all interfaces if none are selected.")
+}
@@ -0,0 +1,183 @@
+package discovery
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/miekg/dns"
+)
+
+// A domain suggested for browsing or registering services in, from a PTR like
+// "b._dns-sd._udp.local" (RFC 6763 section 11).
+type BrowseDomain struct {
+	Kind   string // the first label of the PTR's name: b, db, r, dr, or lb
+	Domain string // the domain being suggested, e.g. "example.com."
+
+	PTR      CachedRecord
+	LastSeen time.Time
+}
+
+// What each kind of browse domain PTR is for, per RFC 6763 section 11.
+var browseDomainKinds = map[string]string{
+	"b":  "Browse",
+	"db": "Default browse",
+	"r":  "Register",
+	"dr": "Default register",
+	"lb": "Legacy browse",
+}
+
+func (d BrowseDomain) Description() string {
+	return browseDomainKinds[d.Kind]
+}
+
+// A service type a responder says it offers, from a PTR like
+// _services._dns-sd._udp.local -> _airplay._tcp.local (RFC 6763 section 9).
+type AdvertisedServiceType struct {
+	Responder   string // the address the PTR came from
+	ServiceType string // the raw DNS-SD service type, e.g. _airplay._tcp
+	Domain      string
+
+	PTR      CachedRecord
+	LastSeen time.Time
+}
+
+// Returns the kind of browse domain PTR a name is for, e.g. "lb" for
+// "lb._dns-sd._udp.local", or false if it isn't one.
+func browseDomainKind(name string) (string, bool) {
+	parts := packet.SplitHost(strings.ToLower(name))
+	if len(parts) < 4 || parts[1] != "_dns-sd" || parts[2] != "_udp" {
+		return "", false
+	}
+	_, ok := browseDomainKinds[parts[0]]
+	return parts[0], ok
+}
+
+// Splits a subtype PTR's name (RFC 6763 section 7.1), e.g.
+// "_universal._sub._ipp._tcp.local", into the subtype and the full name of the
+// service type, e.g. "_universal" and "_ipp._tcp.local.".
+func splitSubtype(name string) (subtype, service string, ok bool) {
+	parts := packet.SplitHost(name)
+	if len(parts) < 5 || !strings.EqualFold(parts[1], "_sub") {
+		return "", "", false
+	}
+	return parts[0], strings.Join(parts[2:], ".") + ".", true
+}
+
+// Replaces the browse domains suggested by a name with the PTRs we have for it.
+func (e *Engine) syncBrowseDomains(name string, seen time.Time) {
+	s := &e.state
+	kind, _ := browseDomainKind(name)
+	before := s.BrowseDomains
+	s.BrowseDomains = slices.DeleteFunc(slices.Clone(s.BrowseDomains), func(d BrowseDomain) bool {
+		return strings.EqualFold(d.PTR.RR.Header().Name, name)
+	})
+	for _, ptr := range e.cache.get(name, dns.TypePTR) {
+		domain := BrowseDomain{
+			Kind:     kind,
+			Domain:   ptr.RR.(*dns.PTR).Ptr,
+			PTR:      ptr,
+			LastSeen: ptr.Received,
+		}
+		// Keep when we last saw a domain we already knew about, if we didn't
+		// just see it again.
+		if i := slices.IndexFunc(before, func(d BrowseDomain) bool { return dns.IsDuplicate(d.PTR.RR, ptr.RR) }); i >= 0 && seen.IsZero() {
+			domain.LastSeen = before[i].LastSeen
+		}
+		s.BrowseDomains = append(s.BrowseDomains, domain)
+	}
+}
+
+// Updates the instances of the service type a subtype PTR is for.
+func (e *Engine) syncSubtype(name string) {
+	_, service, _ := splitSubtype(name)
+	suffix := "." + strings.ToLower(service)
+	for i, instance := range e.state.ServiceInstances {
+		if strings.HasSuffix(strings.ToLower(instance.RawName), suffix) && e.syncInstance(i) {
+			e.changed(Event{Kind: InstanceUpdated, Instance: e.state.ServiceInstances[i]})
+		}
+	}
+}
+
+// Returns the subtypes an instance is advertised under, according to the
+// subtype PTRs in the cache, sorted.
+func (e *Engine) subtypesOf(instance ServiceInstance) []string {
+	var res []string
+	for key, rrset := range e.cache.rrsets {
+		if key.Type != dns.TypePTR {
+			continue
+		}
+		subtype, service, ok := splitSubtype(key.Name)
+		if !ok || !strings.HasSuffix(strings.ToLower(instance.RawName), "."+service) {
+			continue
+		}
+		if slices.ContainsFunc(rrset, func(r CachedRecord) bool { return strings.EqualFold(r.RR.(*dns.PTR).Ptr, instance.RawName) }) {
+			res = append(res, subtype)
+		}
+	}
+	slices.Sort(res)
+	return res
+}
+
+// Records a service type enumeration PTR against the responder that sent it.
+func (e *Engine) trackServiceType(p packet.MDNSPacket, ptr *dns.PTR) {
+	s := &e.state
+	i := slices.IndexFunc(s.ServiceTypes, func(t AdvertisedServiceType) bool {
+		return t.Responder == p.SrcAddr && strings.EqualFold(t.PTR.RR.(*dns.PTR).Ptr, ptr.Ptr)
+	})
+
+	// A TTL of zero is a goodbye
+	if ptr.Hdr.Ttl == 0 {
+		if i >= 0 {
+			s.ServiceTypes = slices.Delete(s.ServiceTypes, i, i+1)
+		}
+		return
+	}
+
+	nameParts := packet.SplitHost(ptr.Ptr)
+	if len(nameParts) < 2 {
+		return
+	}
+	rr := dns.Copy(ptr)
+	rr.Header().Class &^= cacheFlushBit
+	t := AdvertisedServiceType{
+		Responder:   p.SrcAddr,
+		ServiceType: strings.Join(nameParts[:len(nameParts)-1], "."),
+		Domain:      nameParts[len(nameParts)-1],
+		PTR: CachedRecord{
+			RR:        rr,
+			Interface: p.Interface,
+			Received:  p.Timestamp,
+			Expires:   p.Timestamp.Add(time.Duration(ptr.Hdr.Ttl) * time.Second),
+		},
+		LastSeen: p.Timestamp,
+	}
+	if i >= 0 {
+		s.ServiceTypes[i] = t
+	} else {
+		s.ServiceTypes = append(s.ServiceTypes, t)
+	}
+}
+
+// The service types a host says it offers, without duplicates.
+func (s *State) ServiceTypesForHost(host Host) []AdvertisedServiceType {
+	var res []AdvertisedServiceType
+	for _, t := range s.ServiceTypes {
+		if host.HasAddr(t.Responder) && !slices.ContainsFunc(res, func(other AdvertisedServiceType) bool {
+			return other.ServiceType == t.ServiceType
+		}) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// The service types a host says it offers, but that we haven't seen any of its
+// instances of. This happens when instances are only ever sent by unicast.
+func (s *State) UnresolvedServiceTypesForHost(host Host) []AdvertisedServiceType {
+	instances := s.ServiceInstancesForHost(host)
+	return slices.DeleteFunc(s.ServiceTypesForHost(host), func(t AdvertisedServiceType) bool {
+		return slices.ContainsFunc(instances, func(i ServiceInstance) bool { return strings.EqualFold(i.ServiceType, t.ServiceType) })
+	})
+}
@@ -0,0 +1,111 @@
+package discovery
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func makePTR(name, ptr string, ttl uint32) *dns.PTR {
+	return &dns.PTR{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}, Ptr: ptr}
+}
+
+func TestSubtypes(t *testing.T) {
+	e := NewEngine()
+
+	// The subtype PTR may arrive before the instance's own PTR.
+	var msg dns.Msg
+	msg.Response = true
+	msg.Answer = []dns.RR{makePTR("_universal._sub._ipp._tcp.local.", "Printer._ipp._tcp.local.", 4500)}
+	e.HandlePacket(packet.MDNSPacket{Timestamp: testTime, SrcAddr: "192.168.1.9", SrcPort: 5353, TTL: 255, DNS: msg})
+	assert.Empty(t, e.Instances())
+
+	e.HandlePacket(makeAdvertisement("Printer", "_ipp._tcp", "Printer", net.IPv4(192, 168, 1, 9)))
+	msg.Answer = []dns.RR{makePTR("_cups._sub._ipp._tcp.local.", "Printer._ipp._tcp.local.", 120)}
+	e.HandlePacket(packet.MDNSPacket{Timestamp: testTime.Add(time.Second), SrcAddr: "192.168.1.9", SrcPort: 5353, TTL: 255, DNS: msg})
+
+	instances := e.Instances()
+	if assert.Equal(t, 1, len(instances)) {
+		assert.Equal(t, "_ipp._tcp", instances[0].ServiceType)
+		assert.Equal(t, []string{"_cups", "_universal"}, instances[0].Subtypes)
+	}
+
+	e.Expire(testTime.Add(200 * time.Second))
+	if instances := e.Instances(); assert.Equal(t, 1, len(instances)) {
+		assert.Equal(t, []string{"_universal"}, instances[0].Subtypes)
+	}
+}
+
+func TestBrowseDomains(t *testing.T) {
+	e := NewEngine()
+
+	var msg dns.Msg
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		makePTR("lb._dns-sd._udp.local.", "local.", 4500),
+		makePTR("b._dns-sd._udp.1.168.192.in-addr.arpa.", "example.com.", 4500),
+	}
+	e.HandlePacket(packet.MDNSPacket{Timestamp: testTime, SrcAddr: "192.168.1.1", SrcPort: 5353, TTL: 255, DNS: msg})
+
+	state := e.Snapshot()
+	assert.Empty(t, state.ServiceInstances)
+	if assert.Equal(t, 2, len(state.BrowseDomains)) {
+		assert.Equal(t, "lb", state.BrowseDomains[0].Kind)
+		assert.Equal(t, "Legacy browse", state.BrowseDomains[0].Description())
+		assert.Equal(t, "local.", state.BrowseDomains[0].Domain)
+		assert.Equal(t, "b", state.BrowseDomains[1].Kind)
+		assert.Equal(t, "example.com.", state.BrowseDomains[1].Domain)
+	}
+
+	// Goodbye
+	msg.Answer = []dns.RR{makePTR("lb._dns-sd._udp.local.", "local.", 0)}
+	e.HandlePacket(packet.MDNSPacket{Timestamp: testTime.Add(time.Second), SrcAddr: "192.168.1.1", SrcPort: 5353, TTL: 255, DNS: msg})
+	if domains := e.Snapshot().BrowseDomains; assert.Equal(t, 1, len(domains)) {
+		assert.Equal(t, "example.com.", domains[0].Domain)
+	}
+}
+
+func TestServiceTypes(t *testing.T) {
+	e := NewEngine()
+	e.HandlePacket(makeAdvertisement("Printer", "_ipp._tcp", "Printer", net.IPv4(192, 168, 1, 9)))
+
+	var msg dns.Msg
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		makePTR("_services._dns-sd._udp.local.", "_ipp._tcp.local.", 4500),
+		makePTR("_services._dns-sd._udp.local.", "_http._tcp.local.", 60),
+	}
+	e.HandlePacket(packet.MDNSPacket{Timestamp: testTime, SrcAddr: "192.168.1.9", SrcPort: 5353, TTL: 255, DNS: msg})
+	// Another responder offering the same type
+	msg.Answer = msg.Answer[:1]
+	e.HandlePacket(packet.MDNSPacket{Timestamp: testTime, SrcAddr: "192.168.1.10", SrcPort: 5353, TTL: 255, DNS: msg})
+
+	state := e.Snapshot()
+	assert.Equal(t, 3, len(state.ServiceTypes))
+	printer := state.Hosts[0]
+	assert.Equal(t, 2, len(state.ServiceTypesForHost(printer)))
+	if unresolved := state.UnresolvedServiceTypesForHost(printer); assert.Equal(t, 1, len(unresolved)) {
+		assert.Equal(t, "_http._tcp", unresolved[0].ServiceType)
+		assert.Equal(t, "local", unresolved[0].Domain)
+	}
+
+	e.Expire(testTime.Add(60 * time.Second))
+	state = e.Snapshot()
+	assert.Equal(t, 2, len(state.ServiceTypes))
+	assert.Empty(t, state.UnresolvedServiceTypesForHost(state.Hosts[0]))
+
+	// Known answers in a query are what the querier has heard from others, not
+	// what it offers.
+	var query dns.Msg
+	query.SetQuestion("_services._dns-sd._udp.local.", dns.TypePTR)
+	query.Answer = []dns.RR{makePTR("_services._dns-sd._udp.local.", "_raop._tcp.local.", 4500)}
+	e.HandlePacket(packet.MDNSPacket{Timestamp: testTime.Add(61 * time.Second), SrcAddr: "192.168.1.11", SrcPort: 5353, TTL: 255, DNS: query})
+	state = e.Snapshot()
+	assert.Equal(t, 2, len(state.ServiceTypes))
+	assert.False(t, slices.ContainsFunc(state.ServiceTypes, func(t AdvertisedServiceType) bool { return t.Responder == "192.168.1.11" }))
+}
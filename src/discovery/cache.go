@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The top bit of the class of an mDNS record is the cache-flush bit (RFC 6762
+// section 10.2), which says that this record replaces any others with the same
+// name and type.
+const cacheFlushBit = 1 << 15
+
+// How long records are kept around after another record of the same name and
+// type arrives with the cache-flush bit set (RFC 6762 section 10.2).
+const cacheFlushGrace = time.Second
+
+// A record we have received, with what we need to expire it.
+type CachedRecord struct {
+	RR         dns.RR // with the cache-flush bit cleared
+	CacheFlush bool   // whether the record was sent with the cache-flush bit
+	Interface  string // the interface the record was received on, if known
+	Received   time.Time
+	Expires    time.Time
+}
+
+// How much of the record's lifetime is left, from 1 (fresh) to 0 (expired).
+// Queriers re-query at 80% of a record's TTL (RFC 6762 section 5.2), so a
+// record is considered fresh until then and fades out after. The zero
+// CachedRecord is always fresh.
+func (r CachedRecord) Freshness(now time.Time) float64 {
+	return freshness(r.Received, r.Expires, now)
+}
+
+func freshness(received, expires, now time.Time) float64 {
+	if expires.IsZero() {
+		return 1
+	}
+	lifetime := expires.Sub(received)
+	staleAt := received.Add(lifetime * 8 / 10)
+	if !now.After(staleAt) {
+		return 1
+	}
+	if !now.Before(expires) {
+		return 0
+	}
+	return float64(expires.Sub(now)) / float64(expires.Sub(staleAt))
+}
+
+type recordKey struct {
+	Name string // lowercase, since DNS names are case-insensitive
+	Type uint16
+}
+
+func keyOf(rr dns.RR) recordKey {
+	return recordKey{Name: strings.ToLower(rr.Header().Name), Type: rr.Header().Rrtype}
+}
+
+// The records we have received, organized into rrsets, following the caching
+// rules of RFC 6762.
+type recordCache struct {
+	rrsets map[recordKey][]CachedRecord
+}
+
+// Adds a record to the cache, returning true if the contents of its rrset
+// changed (and not just its expiry).
+func (c *recordCache) add(rr dns.RR, now time.Time, intf string) bool {
+	if c.rrsets == nil {
+		c.rrsets = make(map[recordKey][]CachedRecord)
+	}
+
+	cacheFlush := rr.Header().Class&cacheFlushBit != 0
+	rr = dns.Copy(rr)
+	rr.Header().Class &^= cacheFlushBit
+
+	key := keyOf(rr)
+	rrset := c.rrsets[key]
+	changed := false
+
+	// A TTL of zero is a goodbye: the record is going away right now (RFC 6762
+	// section 10.1).
+	if rr.Header().Ttl == 0 {
+		before := len(rrset)
+		rrset = slices.DeleteFunc(rrset, func(r CachedRecord) bool { return dns.IsDuplicate(r.RR, rr) })
+		c.set(key, rrset)
+		return len(rrset) != before
+	}
+
+	if cacheFlush {
+		// Everything else in the rrset is out of date, but we give it a
+		// second to allow for the rest of the rrset arriving in other packets.
+		for i := range rrset {
+			r := &rrset[i]
+			if !dns.IsDuplicate(r.RR, rr) && now.Sub(r.Received) > cacheFlushGrace {
+				if flushAt := now.Add(cacheFlushGrace); flushAt.Before(r.Expires) {
+					r.Expires = flushAt
+				}
+			}
+		}
+	}
+
+	record := CachedRecord{
+		RR:         rr,
+		CacheFlush: cacheFlush,
+		Interface:  intf,
+		Received:   now,
+		Expires:    now.Add(time.Duration(rr.Header().Ttl) * time.Second),
+	}
+	if i := slices.IndexFunc(rrset, func(r CachedRecord) bool { return dns.IsDuplicate(r.RR, rr) }); i >= 0 {
+		rrset[i] = record
+	} else {
+		rrset = append(rrset, record)
+		changed = true
+	}
+	c.set(key, rrset)
+	return changed
+}
+
+func (c *recordCache) set(key recordKey, rrset []CachedRecord) {
+	if len(rrset) == 0 {
+		delete(c.rrsets, key)
+	} else {
+		c.rrsets[key] = rrset
+	}
+}
+
+// Returns the rrset with the given name and type.
+func (c *recordCache) get(name string, rrtype uint16) []CachedRecord {
+	return c.rrsets[recordKey{Name: strings.ToLower(name), Type: rrtype}]
+}
+
+// Removes all expired records, returning the keys of the rrsets that changed.
+func (c *recordCache) expire(now time.Time) []recordKey {
+	var changed []recordKey
+	for key, rrset := range c.rrsets {
+		before := len(rrset)
+		rrset = slices.DeleteFunc(rrset, func(r CachedRecord) bool { return !now.Before(r.Expires) })
+		if len(rrset) != before {
+			changed = append(changed, key)
+			c.set(key, rrset)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,283 @@
+// Package discovery interprets mDNS and DNS-SD traffic, building up a model of
+// the hosts on the network, the services they advertise, and the services they
+// are looking for.
+//
+// It has no dependency on the UI or on cgo, so it can be embedded in other
+// programs:
+//
+//	engine := discovery.NewEngine()
+//	capture, err := packet.ListenMDNS(nil, packet.CaptureMulticast)
+//	...
+//	events, unsubscribe := engine.Subscribe(100)
+//	defer unsubscribe()
+//	go engine.Run(capture)
+//	for ev := range events { ... }
+package discovery
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/miekg/dns"
+)
+
+type EventKind int
+
+const (
+	HostAdded EventKind = iota + 1
+	HostUpdated
+	HostRemoved
+	InstanceAdded
+	InstanceUpdated
+	InstanceRemoved
+	QueryAdded
+	// Hosts were merged into or split off from devices by hand. No field of
+	// the event is set; see Devices for the new grouping.
+	DevicesChanged
+	// The engine was reset, and all previous hosts, instances and queries are
+	// gone.
+	Reset
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case HostAdded:
+		return "HostAdded"
+	case HostUpdated:
+		return "HostUpdated"
+	case HostRemoved:
+		return "HostRemoved"
+	case InstanceAdded:
+		return "InstanceAdded"
+	case InstanceUpdated:
+		return "InstanceUpdated"
+	case InstanceRemoved:
+		return "InstanceRemoved"
+	case QueryAdded:
+		return "QueryAdded"
+	case DevicesChanged:
+		return "DevicesChanged"
+	case Reset:
+		return "Reset"
+	default:
+		return "EventKind(?)"
+	}
+}
+
+// A change to an Engine's state. Only the field matching the Kind is set, and
+// it holds a copy of the item after the change (or, for removals, just before
+// it).
+type Event struct {
+	Kind     EventKind
+	Host     Host
+	Instance ServiceInstance
+	Query    ServiceQuery
+}
+
+// An Engine turns a stream of mDNS packets into a State. It is safe for
+// concurrent use, although packets should be fed to it from a single goroutine
+// so that they are applied in order.
+type Engine struct {
+	// If set, every record we process is logged.
+	Verbose bool
+
+	mu     sync.RWMutex
+	state  State
+	cache  recordCache
+	events []Event // produced while processing, sent once the lock is released
+
+	// Kept across resets, since they are the user's decisions rather than
+	// something we learned from the network.
+	overrides identityOverrides
+
+	subsMu  sync.Mutex
+	subs    []*subscription
+	dropped atomic.Int64
+}
+
+type subscription struct {
+	ch chan Event
+}
+
+func NewEngine() *Engine {
+	return &Engine{}
+}
+
+// Updates the state with the contents of a single packet.
+func (e *Engine) HandlePacket(p packet.MDNSPacket) {
+	e.mu.Lock()
+	e.processPacket(p)
+	events := e.events
+	e.events = nil
+	e.mu.Unlock()
+
+	e.publish(events)
+}
+
+// Handles every packet from a source until it is closed. Malformed packets are
+// discarded.
+func (e *Engine) Run(source packet.Source) {
+	go func() {
+		for range source.Malformed() {
+		}
+	}()
+	for p := range source.Packets() {
+		e.HandlePacket(p)
+	}
+}
+
+// Throws away everything the engine has learned, starting over with the given
+// hosts (e.g. the machine we are running on).
+func (e *Engine) Reset(hosts ...Host) {
+	e.mu.Lock()
+	e.state = State{Hosts: hosts}
+	e.cache = recordCache{}
+	e.mu.Unlock()
+
+	events := []Event{{Kind: Reset}}
+	for _, host := range hosts {
+		events = append(events, Event{Kind: HostAdded, Host: host})
+	}
+	e.publish(events)
+}
+
+// Removes everything whose records have expired as of the given time. Records
+// also expire as newer packets arrive, so this is only needed to keep a live
+// capture up to date when the network goes quiet.
+func (e *Engine) Expire(now time.Time) {
+	e.mu.Lock()
+	e.advance(now)
+	events := e.events
+	e.events = nil
+	e.mu.Unlock()
+
+	e.publish(events)
+}
+
+// Returns a consistent copy of the whole state.
+func (e *Engine) Snapshot() State {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	res := e.state.Clone()
+	res.Devices = groupDevices(&res, &e.overrides)
+	for key, rrset := range e.cache.rrsets {
+		if (key.Type == dns.TypeSRV || key.Type == dns.TypeTXT) && e.instanceIndex(key.Name) < 0 {
+			for _, r := range rrset {
+				res.DeferredRRs = append(res.DeferredRRs, r.RR)
+			}
+		}
+	}
+	// The cache is a map, so sort them to keep the order from jumping around.
+	slices.SortStableFunc(res.DeferredRRs, func(a, b dns.RR) int {
+		if c := strings.Compare(a.Header().Name, b.Header().Name); c != 0 {
+			return c
+		}
+		return int(a.Header().Rrtype) - int(b.Header().Rrtype)
+	})
+	return res
+}
+
+// Treats two hosts as the same device, even if nothing says they are.
+func (e *Engine) Merge(a, b string) {
+	e.mu.Lock()
+	e.overrides.merge(a, b)
+	e.mu.Unlock()
+
+	e.publish([]Event{{Kind: DevicesChanged}})
+}
+
+// Takes a host out of its device, undoing any merges involving it. From now on
+// the host is only merged with others by hand.
+func (e *Engine) Split(name string) {
+	e.mu.Lock()
+	e.overrides.split(name)
+	e.mu.Unlock()
+
+	e.publish([]Event{{Kind: DevicesChanged}})
+}
+
+func (e *Engine) Hosts() []Host {
+	return e.Snapshot().Hosts
+}
+
+func (e *Engine) Instances() []ServiceInstance {
+	return e.Snapshot().ServiceInstances
+}
+
+func (e *Engine) Queries() []ServiceQuery {
+	return e.Snapshot().ServiceQueries
+}
+
+func (e *Engine) Questions() []Question {
+	return e.Snapshot().Questions
+}
+
+func (e *Engine) Devices() []Device {
+	return e.Snapshot().Devices
+}
+
+// Returns a channel that receives every change to the state, and a function
+// to stop receiving them. Events are delivered in order. The engine never waits
+// for a subscriber, so events that don't fit in the channel's buffer are
+// dropped and counted in Dropped; a subscriber that falls behind should take a
+// new Snapshot.
+func (e *Engine) Subscribe(buffer int) (<-chan Event, func()) {
+	sub := &subscription{
+		ch: make(chan Event, buffer),
+	}
+
+	e.subsMu.Lock()
+	e.subs = append(e.subs, sub)
+	e.subsMu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			e.subsMu.Lock()
+			defer e.subsMu.Unlock()
+			e.subs = slices.DeleteFunc(e.subs, func(s *subscription) bool { return s == sub })
+			close(sub.ch)
+		})
+	}
+}
+
+func (e *Engine) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	e.subsMu.Lock()
+	defer e.subsMu.Unlock()
+	for _, sub := range e.subs {
+		for _, ev := range events {
+			select {
+			case sub.ch <- ev:
+			default:
+				e.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// The number of events that have been dropped because a subscriber's channel
+// was full.
+func (e *Engine) Dropped() int64 {
+	return e.dropped.Load()
+}
+
+// Records a change while processing a packet.
+func (e *Engine) changed(ev Event) {
+	e.events = append(e.events, ev)
+}
+
+func (e *Engine) logf(format string, args ...any) {
+	if e.Verbose {
+		log.Printf(format, args...)
+	}
+}
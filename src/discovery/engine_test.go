@@ -0,0 +1,404 @@
+package discovery
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+var testTime = time.Unix(1700000000, 0)
+
+func makeAdvertisement(instance, service, host string, ip net.IP) packet.MDNSPacket {
+	instanceName := instance + "." + service + ".local."
+	hostName := host + ".local."
+
+	var msg dns.Msg
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		&dns.PTR{Hdr: dns.RR_Header{Name: service + ".local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500}, Ptr: instanceName},
+	}
+	msg.Extra = []dns.RR{
+		&dns.SRV{Hdr: dns.RR_Header{Name: instanceName, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120}, Target: hostName, Port: 7000},
+		&dns.TXT{Hdr: dns.RR_Header{Name: instanceName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 4500}, Txt: []string{"model=MacBookPro18,3"}},
+		&dns.A{Hdr: dns.RR_Header{Name: hostName, Rrtype: dns.TypeA, Class: dns.ClassINET | cacheFlushBit, Ttl: 120}, A: ip},
+	}
+	return packet.MDNSPacket{
+		Timestamp: testTime,
+		SrcAddr:   ip.String(),
+		SrcPort:   5353,
+		SrcMAC:    net.HardwareAddr{0xa6, 0xd9, 0x07, 0xaa, 0xac, 0x61},
+		TTL:       255,
+		DNS:       msg,
+	}
+}
+
+func makeQuery(src, service string) packet.MDNSPacket {
+	var msg dns.Msg
+	msg.SetQuestion(service+".local.", dns.TypePTR)
+	return packet.MDNSPacket{Timestamp: testTime, SrcAddr: src, SrcPort: 5353, TTL: 255, DNS: msg}
+}
+
+func TestEngine(t *testing.T) {
+	e := NewEngine()
+	e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+	e.HandlePacket(makeQuery("192.168.1.6", "_airplay._tcp"))
+
+	state := e.Snapshot()
+	if assert.Equal(t, 1, len(state.ServiceInstances)) {
+		instance := state.ServiceInstances[0]
+		assert.Equal(t, "MacBook Pro", instance.InstanceName)
+		assert.Equal(t, "_airplay._tcp", instance.ServiceType)
+		assert.Equal(t, "local", instance.Domain)
+		assert.Equal(t, "MacBook-Pro.local.", instance.Host)
+		assert.Equal(t, 7000, instance.Port)
+		assert.Equal(t, []string{"model=MacBookPro18,3"}, instance.Extras)
+	}
+	assert.Empty(t, state.DeferredRRs)
+
+	if assert.Equal(t, 2, len(state.Hosts)) {
+		host := state.Hosts[0]
+		assert.Equal(t, "MacBook-Pro.local.", host.Name)
+		assert.Equal(t, "192.168.1.5", host.IPv4Addr())
+		assert.Equal(t, []string{"a6:d9:07:aa:ac:61"}, host.MACs)
+		assert.Equal(t, testTime, host.LastSeen)
+		assert.Equal(t, 1, len(state.ServiceInstancesForHost(host)))
+	}
+
+	if assert.Equal(t, 1, len(state.ServiceQueries)) {
+		query := state.ServiceQueries[0]
+		assert.Equal(t, "192.168.1.6", query.SourceAddr)
+		assert.Equal(t, "_airplay._tcp", query.ServiceType)
+		assert.Equal(t, 1, len(state.ServiceQueriesForHost(Host{Addresses: []HostAddress{{Addr: "192.168.1.6"}}})))
+	}
+}
+
+func TestEngineEscapedNames(t *testing.T) {
+	e := NewEngine()
+	e.HandlePacket(makeAdvertisement(`Jane's Mac\.home`, "_ssh._tcp", "Janes-Mac", net.IPv4(192, 168, 1, 5)))
+
+	if instances := e.Instances(); assert.Equal(t, 1, len(instances)) {
+		assert.Equal(t, "Jane's Mac.home", instances[0].InstanceName)
+		assert.Equal(t, "_ssh._tcp", instances[0].ServiceType)
+		assert.Equal(t, "local", instances[0].Domain)
+		assert.Equal(t, 7000, instances[0].Port)
+	}
+}
+
+func TestEngineSnapshot(t *testing.T) {
+	e := NewEngine()
+	e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+	before := e.Snapshot()
+
+	p := makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 50))
+	p.Timestamp = testTime.Add(time.Second)
+	e.HandlePacket(p)
+	assert.False(t, before.Hosts[0].HasAddr("192.168.1.50"))
+	assert.True(t, e.Hosts()[0].HasAddr("192.168.1.50"))
+}
+
+func TestEngineDeferredRRs(t *testing.T) {
+	e := NewEngine()
+	// Without their PTRs, the SRV and TXT records don't belong to any instance
+	// yet.
+	for _, instance := range []string{"C", "A", "D", "B"} {
+		p := makeAdvertisement(instance, "_airplay._tcp", instance, net.IPv4(192, 168, 1, 5))
+		p.DNS.Answer = nil
+		e.HandlePacket(p)
+	}
+
+	var names []string
+	for _, rr := range e.Snapshot().DeferredRRs {
+		names = append(names, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+	}
+	assert.Equal(t, []string{
+		"A._airplay._tcp.local. TXT",
+		"A._airplay._tcp.local. SRV",
+		"B._airplay._tcp.local. TXT",
+		"B._airplay._tcp.local. SRV",
+		"C._airplay._tcp.local. TXT",
+		"C._airplay._tcp.local. SRV",
+		"D._airplay._tcp.local. TXT",
+		"D._airplay._tcp.local. SRV",
+	}, names)
+}
+
+func TestEngineAddresses(t *testing.T) {
+	e := NewEngine()
+	p := makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5))
+	p.Interface = "en0"
+	p.DNS.Extra = append(p.DNS.Extra, &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: "MacBook-Pro.local.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET | cacheFlushBit, Ttl: 120},
+		AAAA: net.ParseIP("fe80::1"),
+	})
+	e.HandlePacket(p)
+
+	// The same host on another interface, sent in a separate packet. The
+	// cache-flush bit must not knock out the first address, since it was
+	// received less than a second ago.
+	p = makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(10, 0, 0, 5))
+	p.Interface = "en1"
+	p.Timestamp = testTime.Add(500 * time.Millisecond)
+	e.HandlePacket(p)
+	e.HandlePacket(makeQuery("10.0.0.5", "_airplay._tcp"))
+
+	state := e.Snapshot()
+	if !assert.Equal(t, 1, len(state.Hosts)) {
+		return
+	}
+	host := state.Hosts[0]
+	if assert.Equal(t, 3, len(host.Addresses)) {
+		assert.Equal(t, HostAddress{
+			Addr:      "192.168.1.5",
+			Interface: "en0",
+			TTL:       120,
+			LastSeen:  testTime,
+			Expires:   testTime.Add(120 * time.Second),
+		}, host.Addresses[0])
+		assert.Equal(t, "10.0.0.5", host.Addresses[1].Addr)
+		assert.Equal(t, "en1", host.Addresses[1].Interface)
+		assert.Equal(t, "fe80::1", host.Addresses[2].Addr)
+	}
+	assert.Equal(t, "192.168.1.5", host.IPv4Addr())
+	assert.Equal(t, "fe80::1", host.IPv6Addr())
+	assert.Equal(t, 1, len(state.ServiceQueriesForHost(host)))
+}
+
+func TestEngineOffLink(t *testing.T) {
+	e := NewEngine()
+	p := makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5))
+	p.TTL = 63
+	e.HandlePacket(p)
+
+	state := e.Snapshot()
+	assert.Equal(t, 63, state.Hosts[0].OffLinkTTL)
+	if assert.Equal(t, 1, len(state.OffLinkSenders)) {
+		assert.Equal(t, "192.168.1.5", state.OffLinkSenders[0].Addr)
+	}
+}
+
+func TestEngineEvents(t *testing.T) {
+	e := NewEngine()
+	events, unsubscribe := e.Subscribe(100)
+
+	e.Reset(Host{Name: "This PC"})
+	e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+	e.HandlePacket(makeQuery("192.168.1.6", "_airplay._tcp"))
+	unsubscribe()
+	e.HandlePacket(makeQuery("192.168.1.7", "_airplay._tcp")) // must not block or panic
+
+	var kinds []EventKind
+	for ev := range events {
+		kinds = append(kinds, ev.Kind)
+		if ev.Kind == InstanceAdded {
+			assert.Equal(t, "MacBook Pro", ev.Instance.InstanceName)
+		}
+	}
+	assert.Equal(t, []EventKind{
+		Reset, HostAdded,
+		InstanceAdded, HostAdded, HostUpdated,
+		HostAdded, QueryAdded,
+	}, kinds)
+	assert.Equal(t, 4, len(e.Snapshot().Hosts))
+	assert.Equal(t, int64(0), e.Dropped())
+
+	// Slow subscribers lose events rather than holding up the engine.
+	events, unsubscribe = e.Subscribe(1)
+	e.Merge("MacBook-Pro.local.", "192.168.1.6")
+	e.Split("MacBook-Pro.local.")
+	unsubscribe()
+	kinds = nil
+	for ev := range events {
+		kinds = append(kinds, ev.Kind)
+	}
+	assert.Equal(t, []EventKind{DevicesChanged}, kinds)
+	assert.Equal(t, int64(1), e.Dropped())
+}
+
+func TestEngineProvisional(t *testing.T) {
+	e := NewEngine()
+	e.HandlePacket(makeAdvertisement("Printer", "_ipp._tcp", "Printer", net.IPv4(192, 168, 1, 9)))
+	query := makeQuery("192.168.1.6", "_airplay._tcp")
+	query.SrcMAC = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	e.HandlePacket(query)
+
+	state := e.Snapshot()
+	if !assert.Equal(t, 2, len(state.Hosts)) {
+		return
+	}
+	phone := state.Hosts[1]
+	assert.True(t, phone.Provisional)
+	assert.Equal(t, "192.168.1.6", phone.Name)
+	assert.Equal(t, []string{"00:11:22:33:44:55"}, phone.MACs)
+	assert.Equal(t, 1, len(state.ServiceQueriesForHost(phone)))
+	assert.True(t, state.Devices[1].Provisional())
+
+	// Once the phone announces its address, the provisional host is replaced.
+	events, unsubscribe := e.Subscribe(100)
+	announcement := makeAdvertisement("iPhone", "_companion-link._tcp", "iPhone", net.IPv4(192, 168, 1, 6))
+	announcement.Timestamp = testTime.Add(time.Second)
+	announcement.SrcMAC = query.SrcMAC
+	e.HandlePacket(announcement)
+	unsubscribe()
+
+	var kinds []EventKind
+	for ev := range events {
+		kinds = append(kinds, ev.Kind)
+	}
+	assert.Equal(t, []EventKind{InstanceAdded, HostRemoved, HostAdded}, kinds)
+
+	state = e.Snapshot()
+	if assert.Equal(t, 2, len(state.Hosts)) {
+		phone = state.Hosts[1]
+		assert.False(t, phone.Provisional)
+		assert.Equal(t, "iPhone.local.", phone.Name)
+		assert.Equal(t, []string{"00:11:22:33:44:55"}, phone.MACs)
+		assert.Equal(t, 1, len(state.ServiceQueriesForHost(phone)))
+	}
+}
+
+func TestEngineMergedFile(t *testing.T) {
+	e := NewEngine()
+	now := testTime.Add(24 * time.Hour)
+	live := makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5))
+	live.Timestamp = now
+	e.HandlePacket(live)
+
+	// A file captured a day earlier, moved to end now as the UI does when it
+	// merges a file into the live view.
+	file := []packet.MDNSPacket{
+		makeAdvertisement("Printer", "_ipp._tcp", "Printer", net.IPv4(192, 168, 1, 9)),
+		makeQuery("192.168.1.6", "_ipp._tcp"),
+	}
+	file[1].Timestamp = testTime.Add(10 * time.Second)
+	for _, p := range file {
+		e.HandlePacket(p.Shifted(now.Sub(file[1].Timestamp)))
+	}
+
+	// The live clock ticks on, and the file's records are still around.
+	e.Expire(now.Add(time.Second))
+	state := e.Snapshot()
+	assert.Equal(t, 2, len(state.ServiceInstances))
+	assert.Equal(t, 1, len(state.ServiceQueries))
+	assert.Equal(t, 1, len(state.Questions))
+
+	// They expire like any other records.
+	e.Expire(now.Add(2 * time.Minute))
+	assert.False(t, slices.ContainsFunc(e.Hosts(), func(h Host) bool { return h.Name == "Printer.local." }))
+}
+
+func TestEngineProbe(t *testing.T) {
+	e := NewEngine()
+	probe := makeQuery("192.168.1.9", "_ipp._tcp")
+	probe.DNS.Question[0] = dns.Question{Name: "Printer.local.", Qtype: dns.TypeANY, Qclass: dns.ClassINET}
+	probe.DNS.Ns = append(probe.DNS.Ns, &dns.A{
+		Hdr: dns.RR_Header{Name: "Printer.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+		A:   net.IPv4(192, 168, 1, 9),
+	})
+	e.HandlePacket(probe)
+
+	// The prober doesn't own the name yet, so we don't know it by that name.
+	for _, host := range e.Hosts() {
+		assert.NotEqual(t, "Printer.local.", host.Name)
+	}
+
+	e.HandlePacket(makeAdvertisement("Printer", "_ipp._tcp", "Printer", net.IPv4(192, 168, 1, 9)))
+	assert.True(t, slices.ContainsFunc(e.Hosts(), func(h Host) bool { return h.Name == "Printer.local." }))
+}
+
+func TestEngineProvisionalExpiry(t *testing.T) {
+	minutes := func(n int) time.Time { return testTime.Add(time.Duration(n) * time.Minute) }
+	query := func(ts time.Time) packet.MDNSPacket {
+		p := makeQuery("192.168.1.6", "_airplay._tcp")
+		p.Timestamp = ts
+		return p
+	}
+
+	e := NewEngine()
+	e.HandlePacket(query(minutes(0)))
+	e.HandlePacket(query(minutes(3))) // pushes the expiry back
+	e.Expire(minutes(7).Add(30 * time.Second))
+	state := e.Snapshot()
+	if assert.Equal(t, 1, len(state.Hosts)) {
+		assert.True(t, state.Hosts[0].Provisional)
+		freshness := state.Hosts[0].Freshness(state.Now)
+		assert.Less(t, freshness, 1.0)
+		assert.Greater(t, freshness, 0.0)
+	}
+
+	events, unsubscribe := e.Subscribe(100)
+	e.Expire(minutes(8))
+	unsubscribe()
+	assert.Empty(t, e.Hosts())
+	var kinds []EventKind
+	for ev := range events {
+		kinds = append(kinds, ev.Kind)
+	}
+	assert.Equal(t, []EventKind{HostRemoved}, kinds)
+}
+
+func TestEngineExpiry(t *testing.T) {
+	seconds := func(n int) time.Time { return testTime.Add(time.Duration(n) * time.Second) }
+
+	t.Run("ttl", func(t *testing.T) {
+		e := NewEngine()
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+
+		// The SRV and A records have a TTL of 120 seconds, and the PTR and TXT
+		// 4500 seconds.
+		e.Expire(seconds(60))
+		state := e.Snapshot()
+		assert.Equal(t, 1.0, state.Hosts[0].Freshness(state.Now))
+		e.Expire(seconds(108))
+		state = e.Snapshot()
+		assert.InDelta(t, 0.5, state.Hosts[0].Freshness(state.Now), 0.001)
+
+		e.Expire(seconds(120))
+		state = e.Snapshot()
+		assert.Empty(t, state.Hosts)
+		if assert.Equal(t, 1, len(state.ServiceInstances)) {
+			instance := state.ServiceInstances[0]
+			assert.Equal(t, "", instance.Host)
+			assert.Equal(t, []string{"model=MacBookPro18,3"}, instance.Extras)
+		}
+
+		e.Expire(seconds(4500))
+		assert.Empty(t, e.Instances())
+	})
+
+	t.Run("goodbye", func(t *testing.T) {
+		e := NewEngine()
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+
+		goodbye := makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5))
+		goodbye.Timestamp = seconds(1)
+		goodbye.DNS.Answer[0].Header().Ttl = 0
+		goodbye.DNS.Extra = nil
+		e.HandlePacket(goodbye)
+
+		assert.Empty(t, e.Instances())
+		assert.Equal(t, 1, len(e.Hosts()))
+	})
+
+	t.Run("cache flush", func(t *testing.T) {
+		e := NewEngine()
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+
+		moved := makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 50))
+		moved.Timestamp = seconds(10)
+		e.HandlePacket(moved)
+		assert.Equal(t, 2, len(e.Hosts()[0].Addresses))
+
+		// The old address gets a second's grace, then is flushed.
+		e.Expire(seconds(11))
+		if hosts := e.Hosts(); assert.Equal(t, 1, len(hosts)) {
+			assert.Equal(t, "192.168.1.50", hosts[0].IPv4Addr())
+			assert.Equal(t, 1, len(hosts[0].Addresses))
+		}
+		assert.Equal(t, 1, len(e.cache.get("MacBook-Pro.local.", dns.TypeA)))
+	})
+}
@@ -0,0 +1,240 @@
+package discovery
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A physical device, made up of all the hosts we believe to be the same
+// machine. One device often has several hosts: its .local name, an old name
+// from before it was renamed (e.g. MacBook-Pro-3 vs. MacBook-Pro-4), or "This
+// PC" for the machine we are running on.
+type Device struct {
+	// The name of the device's first host. It stays the same for as long as
+	// that host is around, so it can be used to keep track of the device.
+	ID    string
+	Hosts []Host
+	// Why the hosts were grouped together, for display. Empty if the device
+	// has only one host.
+	Reasons []string
+}
+
+func (d Device) HasHost(name string) bool {
+	return slices.ContainsFunc(d.Hosts, func(h Host) bool { return strings.EqualFold(h.Name, name) })
+}
+
+// All the addresses of all the device's hosts, without duplicates.
+func (d Device) Addresses() []HostAddress {
+	var res []HostAddress
+	for _, host := range d.Hosts {
+		for _, addr := range host.Addresses {
+			if !slices.ContainsFunc(res, func(a HostAddress) bool { return a.Addr == addr.Addr }) {
+				res = append(res, addr)
+			}
+		}
+	}
+	return res
+}
+
+func (d Device) MACs() []string {
+	var res []string
+	for _, host := range d.Hosts {
+		for _, mac := range host.MACs {
+			if !slices.Contains(res, mac) {
+				res = append(res, mac)
+			}
+		}
+	}
+	return res
+}
+
+// Whether we have only seen the device sending queries.
+func (d Device) Provisional() bool {
+	return !slices.ContainsFunc(d.Hosts, func(h Host) bool { return !h.Provisional })
+}
+
+// How fresh the device's freshest host is. See Host.Freshness.
+func (d Device) Freshness(now time.Time) float64 {
+	res := 0.0
+	for _, host := range d.Hosts {
+		res = max(res, host.Freshness(now))
+	}
+	return res
+}
+
+func (s *State) DeviceForHost(name string) (Device, bool) {
+	for _, d := range s.Devices {
+		if d.HasHost(name) {
+			return d, true
+		}
+	}
+	return Device{}, false
+}
+
+func (s *State) DeviceForAddr(addr string) (Device, bool) {
+	for _, d := range s.Devices {
+		if slices.ContainsFunc(d.Hosts, func(h Host) bool { return h.HasAddr(addr) }) {
+			return d, true
+		}
+	}
+	return Device{}, false
+}
+
+func (s *State) ServiceQueriesForDevice(d Device) []ServiceQuery {
+	return s.serviceQueriesFrom(func(addr string) bool {
+		return slices.ContainsFunc(d.Hosts, func(h Host) bool { return h.HasAddr(addr) })
+	})
+}
+
+func (s *State) ServiceInstancesForDevice(d Device) []ServiceInstance {
+	var res []ServiceInstance
+	for _, host := range d.Hosts {
+		res = append(res, s.ServiceInstancesForHost(host)...)
+	}
+	return res
+}
+
+// Identifiers in TXT records and instance names that stay the same when a
+// device changes its name or address.
+func instanceIdentifiers(instance ServiceInstance) []string {
+	var res []string
+	// AirPlay, e.g. deviceid=A6:D9:07:AA:AC:61
+	if id, _ := instance.Attributes.Get("deviceid"); id != "" {
+		res = append(res, "device ID "+normalizeDeviceID(id))
+	}
+	// AirPlay pairing identity, a UUID
+	if pi, _ := instance.Attributes.Get("pi"); pi != "" {
+		res = append(res, "pairing ID "+strings.ToLower(pi))
+	}
+	// RAOP instances are named after the device ID, e.g. A6D907AAAC61@Living
+	// Room, which matches the deviceid of the AirPlay instance.
+	if instance.ServiceType == "_raop._tcp" {
+		if id, _, ok := strings.Cut(instance.InstanceName, "@"); ok && id != "" {
+			res = append(res, "device ID "+normalizeDeviceID(id))
+		}
+	}
+	return res
+}
+
+func normalizeDeviceID(id string) string {
+	return strings.ToLower(strings.ReplaceAll(id, ":", ""))
+}
+
+// The user's own decisions about which hosts are the same device, which
+// override what we work out for ourselves.
+type identityOverrides struct {
+	merges [][2]string         // pairs of lowercase host names
+	splits map[string]struct{} // lowercase names of hosts that are only merged by hand
+}
+
+func (o *identityOverrides) merge(a, b string) {
+	o.merges = append(o.merges, [2]string{strings.ToLower(a), strings.ToLower(b)})
+}
+
+func (o *identityOverrides) split(name string) {
+	name = strings.ToLower(name)
+	if o.splits == nil {
+		o.splits = make(map[string]struct{})
+	}
+	o.splits[name] = struct{}{}
+	o.merges = slices.DeleteFunc(o.merges, func(m [2]string) bool { return m[0] == name || m[1] == name })
+}
+
+func (o *identityOverrides) isSplit(name string) bool {
+	_, ok := o.splits[strings.ToLower(name)]
+	return ok
+}
+
+// Groups hosts into devices. Hosts are merged if they share an address, an
+// on-link MAC address, or an identifier from a TXT record (see
+// instanceIdentifiers), or if the user merged them by hand.
+func groupDevices(s *State, overrides *identityOverrides) []Device {
+	// A union-find over the indices of s.Hosts
+	parent := make([]int, len(s.Hosts))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	type mergeReason struct {
+		host   int
+		reason string
+	}
+	var reasons []mergeReason
+	union := func(a, b int, reason string) {
+		ra, rb := find(a), find(b)
+		if ra == rb {
+			return
+		}
+		// The lower index wins, so that a device keeps the ID of its
+		// oldest host.
+		parent[max(ra, rb)] = min(ra, rb)
+		reasons = append(reasons, mergeReason{a, reason})
+	}
+
+	// Hosts claiming each piece of evidence, in order
+	seen := make(map[string]int)
+	link := func(i int, evidence, description string) {
+		if j, ok := seen[evidence]; ok {
+			union(j, i, fmt.Sprintf("%s and %s share %s", s.Hosts[j].Name, s.Hosts[i].Name, description))
+		} else {
+			seen[evidence] = i
+		}
+	}
+	for i, host := range s.Hosts {
+		if overrides.isSplit(host.Name) {
+			continue
+		}
+		for _, addr := range host.Addresses {
+			link(i, "addr "+addr.Addr, "address "+addr.Addr)
+		}
+		// Everything from beyond the local link has the MAC of the router it
+		// came through.
+		if host.OffLinkTTL == 0 {
+			for _, mac := range host.MACs {
+				link(i, "mac "+mac, "MAC address "+mac)
+			}
+		}
+		for _, instance := range s.ServiceInstancesForHost(host) {
+			for _, id := range instanceIdentifiers(instance) {
+				link(i, id, id)
+			}
+		}
+	}
+
+	hostIndex := func(name string) int {
+		return slices.IndexFunc(s.Hosts, func(h Host) bool { return strings.EqualFold(h.Name, name) })
+	}
+	for _, m := range overrides.merges {
+		a, b := hostIndex(m[0]), hostIndex(m[1])
+		if a >= 0 && b >= 0 {
+			union(a, b, fmt.Sprintf("%s and %s were merged by hand", s.Hosts[a].Name, s.Hosts[b].Name))
+		}
+	}
+
+	var res []Device
+	deviceIndex := make(map[int]int) // root host index to index in res
+	for i, host := range s.Hosts {
+		root := find(i)
+		di, ok := deviceIndex[root]
+		if !ok {
+			di = len(res)
+			deviceIndex[root] = di
+			res = append(res, Device{ID: s.Hosts[root].Name})
+		}
+		res[di].Hosts = append(res[di].Hosts, host)
+	}
+	for _, r := range reasons {
+		di := deviceIndex[find(r.host)]
+		res[di].Reasons = append(res[di].Reasons, r.reason)
+	}
+	return res
+}
@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func deviceHostNames(devices []Device) [][]string {
+	var res [][]string
+	for _, d := range devices {
+		var names []string
+		for _, host := range d.Hosts {
+			names = append(names, host.Name)
+		}
+		res = append(res, names)
+	}
+	return res
+}
+
+func TestDevices(t *testing.T) {
+	t.Run("address", func(t *testing.T) {
+		e := NewEngine()
+		e.Reset(Host{Name: "This PC", Addresses: []HostAddress{{Addr: "192.168.1.5"}}})
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+		printer := makeAdvertisement("Printer", "_ipp._tcp", "Printer", net.IPv4(192, 168, 1, 9))
+		printer.SrcMAC = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+		e.HandlePacket(printer)
+
+		devices := e.Devices()
+		assert.Equal(t, [][]string{{"This PC", "MacBook-Pro.local."}, {"Printer.local."}}, deviceHostNames(devices))
+		assert.Equal(t, "This PC", devices[0].ID)
+		assert.Equal(t, []string{"This PC and MacBook-Pro.local. share address 192.168.1.5"}, devices[0].Reasons)
+	})
+
+	t.Run("renamed", func(t *testing.T) {
+		// The same machine under an old and a new name, with a new address,
+		// tied together by the deviceid in its TXT record.
+		e := NewEngine()
+		old := makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro-3", net.IPv4(192, 168, 1, 5))
+		old.DNS.Extra[1].(*dns.TXT).Txt = []string{"deviceid=A6:D9:07:AA:AC:61"}
+		old.SrcMAC = nil
+		e.HandlePacket(old)
+
+		renamed := makeAdvertisement("A6D907AAAC61@MacBook Pro", "_raop._tcp", "MacBook-Pro-4", net.IPv4(192, 168, 1, 6))
+		renamed.Timestamp = testTime.Add(time.Second)
+		renamed.SrcMAC = nil
+		e.HandlePacket(renamed)
+
+		devices := e.Devices()
+		assert.Equal(t, [][]string{{"MacBook-Pro-3.local.", "MacBook-Pro-4.local."}}, deviceHostNames(devices))
+		assert.Equal(t, []string{"MacBook-Pro-3.local. and MacBook-Pro-4.local. share device ID a6d907aaac61"}, devices[0].Reasons)
+	})
+
+	t.Run("mac", func(t *testing.T) {
+		e := NewEngine()
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_companion-link._tcp", "MacBook-Pro-2", net.IPv4(192, 168, 1, 6)))
+		assert.Equal(t, 1, len(e.Devices()))
+
+		// Routers forward packets from many hosts, so the MAC addresses of
+		// off-link hosts don't count.
+		e = NewEngine()
+		for i, name := range []string{"MacBook-Pro", "MacBook-Pro-2"} {
+			p := makeAdvertisement("MacBook Pro", "_airplay._tcp", name, net.IPv4(10, 0, 0, byte(i+1)))
+			p.TTL = 63
+			e.HandlePacket(p)
+		}
+		assert.Equal(t, 2, len(e.Devices()))
+	})
+
+	t.Run("manual", func(t *testing.T) {
+		e := NewEngine()
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_companion-link._tcp", "MacBook-Pro-2", net.IPv4(192, 168, 1, 6)))
+		printer := makeAdvertisement("Printer", "_ipp._tcp", "Printer", net.IPv4(192, 168, 1, 9))
+		printer.SrcMAC = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+		e.HandlePacket(printer)
+		assert.Equal(t, 2, len(e.Devices()))
+
+		e.Split("MacBook-Pro-2.local.")
+		e.Merge("MacBook-Pro.local.", "Printer.local.")
+		assert.Equal(t, [][]string{{"MacBook-Pro.local.", "Printer.local."}, {"MacBook-Pro-2.local."}}, deviceHostNames(e.Devices()))
+
+		// Splitting undoes manual merges.
+		e.Split("Printer.local.")
+		assert.Equal(t, 3, len(e.Devices()))
+
+		// Manual choices survive a reset.
+		e.Reset()
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_airplay._tcp", "MacBook-Pro", net.IPv4(192, 168, 1, 5)))
+		e.HandlePacket(makeAdvertisement("MacBook Pro", "_companion-link._tcp", "MacBook-Pro-2", net.IPv4(192, 168, 1, 6)))
+		assert.Equal(t, 2, len(e.Devices()))
+	})
+}
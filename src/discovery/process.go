@@ -0,0 +1,570 @@
+package discovery
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/bvisness/buongiorno/src/utils"
+	"github.com/miekg/dns"
+)
+
+// Compiled once, since they are checked against every record.
+var (
+	tcpServicePattern         = packet.MustCompileHostPattern("**._tcp.local")
+	udpServicePattern         = packet.MustCompileHostPattern("**._udp.local")
+	serviceEnumerationPattern = packet.MustCompileHostPattern("_services._dns-sd._udp.local")
+)
+
+// How long a provisional host is kept after the last query it sent.
+const provisionalHostLifetime = 5 * time.Minute
+
+// Whether a name is for a DNS-SD service type or instance.
+func isServiceName(name string) bool {
+	return tcpServicePattern.Matches(name) || udpServicePattern.Matches(name)
+}
+
+// Updates our model of the network with the contents of a single packet. Must
+// be called with the lock held.
+func (e *Engine) processPacket(p packet.MDNSPacket) {
+	s := &e.state
+	e.advance(p.Timestamp)
+	e.trackQuestions(p)
+
+	// Track queries for PTR records
+	for _, question := range p.DNS.Question {
+		switch question.Qtype {
+		case dns.TypePTR:
+			if !isServiceName(question.Name) {
+				// This PTR question is not looking for DNS-SD services
+				break
+			}
+
+			e.trackQuerier(p)
+			nameParts := packet.SplitHost(question.Name)
+			query := ServiceQuery{
+				SourceAddr:  p.SrcAddr,
+				ServiceType: strings.Join(nameParts[:len(nameParts)-1], "."),
+
+				RawQuery: question.Name,
+			}
+			s.ServiceQueries = append(s.ServiceQueries, query)
+			e.changed(Event{Kind: QueryAdded, Query: query})
+		}
+	}
+
+	// DNS-SD recommends that various records be added to the Additional
+	// section in order to flesh out the services being advertised. This
+	// effectively means that we can just treat whatever we find in the
+	// Additional section as if they were extra answers. (Also, it seems like
+	// sometimes we get them in the Authoritative Nameservers section too?
+	// Who knows, just watch 'em all.)
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6763#section-12
+	//
+	// One quirk worth being aware of is that mDNS queries can contain known
+	// answers in the Answers section. For this project we naively trust them
+	// because it fleshes out our graph and because any incorrect entries
+	// will be overridden by a subsequent answer anyway. (Unless they were
+	// unicasted back I suppose, but there's only so much I can do, all
+	// right?)
+	//
+	// The Authority section is a different story. In a response it's just
+	// more records, but in a query it holds the records a host is probing
+	// for, which it doesn't own yet and will give up on if someone else
+	// does (RFC 6762 section 8.2). So those are not cached.
+	answers := p.DNS.Answer
+	answers = append(answers, p.DNS.Extra...)
+	if p.DNS.Response {
+		answers = append(answers, p.DNS.Ns...)
+	}
+	var touched []recordKey
+	for _, answer := range answers {
+		// In DNS-SD, a PTR record indicates that a service is being
+		// advertised. If a PTR record is provided than it is expected that
+		// a SRV and TXT record will also be provided (although this is
+		// seemingly not guaranteed, from my testing).
+		//
+		// The PTR record itself simply contains a Service Instance Name
+		// (https://datatracker.ietf.org/doc/html/rfc6763#section-4.1). For
+		// example, a PTR record for name "_airplay._tcp.local" may map to
+		// the service instance "MacBook Pro (3)._airplay._tcp.local", where
+		// "MacBook Pro (3)" is the instance, "_airplay._tcp" is the service,
+		// and "local" is the domain.
+		//
+		// The corresponding SRV and TXT records would have the name
+		// "MacBook Pro (3)._airplay._tcp.local". The SRV record tells the
+		// mDNS client what host and port to use for the advertised instance,
+		// for example, "MacBook-Pro-3.local" and port 7000. The TXT record
+		// would provide any additional data about the service, e.g. AirPlay
+		// protocol version.
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6763#section-5
+		//
+		// A PTR record for "_services._dns-sd._udp.local" is used for
+		// enumeration of all available services. These are PTRs to PTRS, and
+		// will not have corresponding SRV and TXT records. They don't identify
+		// a specific instance, but they do tell us which service types the
+		// responder offers, even if we never see the instances themselves
+		// (e.g. because they were answered by unicast).
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6763#section-9
+
+		switch rr := answer.(type) {
+		case *dns.PTR:
+			e.logf("Got PTR: %#v", rr)
+			if serviceEnumerationPattern.Matches(rr.Hdr.Name) {
+				// Meta-PTR. These are tracked per responder rather than going
+				// through the cache, since every responder sends the same
+				// name. In a query they are the querier's known answers,
+				// which say nothing about what the querier offers.
+				if p.DNS.Response {
+					e.trackServiceType(p, rr)
+				}
+				continue
+			}
+			if _, ok := browseDomainKind(rr.Hdr.Name); ok {
+				// Suggests a domain to browse in. These aren't always under
+				// .local, so they need to be let through explicitly.
+				break
+			}
+			if _, ok := packet.ParseReverseName(rr.Hdr.Name); ok {
+				// Maps an address back to a host name, which tells us about
+				// the host even if it never sends an A record.
+				break
+			}
+			if !isServiceName(rr.Hdr.Name) {
+				// This PTR is not advertising a service instance.
+				continue
+			}
+		case *dns.SRV:
+			e.logf("Got SRV: %#v", rr)
+			if !isServiceName(rr.Hdr.Name) {
+				// This SRV has nothing to do with a service instance.
+				continue
+			}
+		case *dns.TXT:
+			e.logf("Got TXT: %#v", rr)
+			if !isServiceName(rr.Hdr.Name) {
+				// This TXT has nothing to do with a service instance.
+				continue
+			}
+		case *dns.A:
+			e.logf("Got A: %#v", rr)
+		case *dns.AAAA:
+			e.logf("Got AAAA: %#v", rr)
+		case *dns.OPT:
+			// Not a real record, but options for the whole packet. See
+			// trackSender.
+			continue
+		default:
+			// NSEC, HINFO, and anything else are kept as they are, and shown
+			// alongside the host or instance with the same name.
+			e.logf("Got %s: %#v", dns.TypeToString[rr.Header().Rrtype], rr)
+		}
+
+		// Everything goes through the cache first, which takes care of TTLs,
+		// goodbyes and cache-flushes. Hosts and instances are then updated
+		// from whatever the cache has for the names involved.
+		e.cache.add(answer, p.Timestamp, p.Interface)
+		if key := keyOf(answer); !slices.Contains(touched, key) {
+			touched = append(touched, key)
+		}
+	}
+
+	// PTRs go first, so that SRV and TXT records in the same packet find their
+	// instances.
+	slices.SortStableFunc(touched, func(a, b recordKey) int {
+		return cmpBool(a.Type != dns.TypePTR, b.Type != dns.TypePTR)
+	})
+	for _, key := range touched {
+		e.sync(key, p.Timestamp)
+	}
+
+	e.trackSender(p)
+	e.trackSleepProxy(p, touched)
+	e.trackAnswers(p)
+}
+
+func cmpBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// Moves the engine's clock forward, expiring any records that have run out.
+func (e *Engine) advance(now time.Time) {
+	if now.After(e.state.Now) {
+		e.state.Now = now
+	}
+
+	e.state.ServiceTypes = slices.DeleteFunc(e.state.ServiceTypes, func(t AdvertisedServiceType) bool {
+		return !now.Before(t.PTR.Expires)
+	})
+
+	e.expireQuestions(now)
+
+	e.state.Hosts = slices.DeleteFunc(e.state.Hosts, func(h Host) bool {
+		expired := h.Provisional && h.Freshness(now) == 0
+		if expired {
+			e.changed(Event{Kind: HostRemoved, Host: h})
+		}
+		return expired
+	})
+
+	expired := e.cache.expire(now)
+	slices.SortFunc(expired, func(a, b recordKey) int {
+		if c := cmpBool(a.Type != dns.TypePTR, b.Type != dns.TypePTR); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	for _, key := range expired {
+		e.sync(key, time.Time{})
+	}
+}
+
+// Brings the hosts and instances involving an rrset up to date with the cache.
+// If seen is set, the rrset was just received at that time.
+func (e *Engine) sync(key recordKey, seen time.Time) {
+	switch key.Type {
+	case dns.TypePTR:
+		if _, ok := browseDomainKind(key.Name); ok {
+			e.syncBrowseDomains(key.Name, seen)
+		} else if _, _, ok := splitSubtype(key.Name); ok {
+			e.syncSubtype(key.Name)
+		} else if _, ok := packet.ParseReverseName(key.Name); ok {
+			e.syncReverse(key.Name, seen)
+		} else {
+			e.syncService(key.Name, seen)
+		}
+	case dns.TypeSRV, dns.TypeTXT:
+		if i := e.instanceIndex(key.Name); i >= 0 {
+			if !seen.IsZero() {
+				e.state.ServiceInstances[i].LastSeen = seen
+			}
+			if e.syncInstance(i) {
+				e.changed(Event{Kind: InstanceUpdated, Instance: e.state.ServiceInstances[i]})
+			}
+		}
+	case dns.TypeA, dns.TypeAAAA:
+		e.syncHost(key.Name, seen)
+	default:
+		e.syncRecords(key.Name)
+	}
+}
+
+// Adds and removes the instances of a service type, according to the PTRs we
+// have for it.
+func (e *Engine) syncService(name string, seen time.Time) {
+	s := &e.state
+	ptrs := e.cache.get(name, dns.TypePTR)
+
+	// Remove instances whose PTR is gone
+	s.ServiceInstances = slices.DeleteFunc(s.ServiceInstances, func(instance ServiceInstance) bool {
+		if !strings.EqualFold(instance.PTR.RR.Header().Name, name) {
+			return false
+		}
+		gone := !slices.ContainsFunc(ptrs, func(r CachedRecord) bool {
+			return strings.EqualFold(r.RR.(*dns.PTR).Ptr, instance.RawName)
+		})
+		if gone {
+			e.changed(Event{Kind: InstanceRemoved, Instance: instance})
+		}
+		return gone
+	})
+
+	for _, ptr := range ptrs {
+		// In DNS-SD, a PTR record indicates that a service is being
+		// advertised. See processPacket for all the details.
+		serviceInstanceName := ptr.RR.(*dns.PTR).Ptr
+		if i := e.instanceIndex(serviceInstanceName); i >= 0 {
+			instance := &s.ServiceInstances[i]
+			instance.PTR = ptr
+			if !seen.IsZero() {
+				instance.LastSeen = seen
+			}
+			continue
+		}
+
+		sname, ok := packet.ParseServiceInstanceName(serviceInstanceName)
+		if !ok {
+			e.logf("Ignoring PTR to %q, which is not a service instance name", serviceInstanceName)
+			continue
+		}
+		s.ServiceInstances = append(s.ServiceInstances, ServiceInstance{
+			InstanceName: sname.Instance,
+			ServiceType:  sname.Service,
+			Domain:       sname.Domain, // assuming "local" always per processPacket
+
+			RawName:  serviceInstanceName,
+			PTR:      ptr,
+			LastSeen: utils.OrDefault(seen, ptr.Received),
+		})
+		i := len(s.ServiceInstances) - 1
+		e.syncInstance(i)
+		e.changed(Event{Kind: InstanceAdded, Instance: s.ServiceInstances[i]})
+	}
+}
+
+func (e *Engine) instanceIndex(rawName string) int {
+	return slices.IndexFunc(e.state.ServiceInstances, func(instance ServiceInstance) bool {
+		return strings.EqualFold(instance.RawName, rawName)
+	})
+}
+
+// Updates an instance from its SRV and TXT records, returning true if anything
+// changed. The SRV record tells us the instance's host and port, and the TXT
+// record any extra info.
+func (e *Engine) syncInstance(i int) bool {
+	instance := &e.state.ServiceInstances[i]
+	before := *instance
+
+	instance.SRV = latest(e.cache.get(instance.RawName, dns.TypeSRV))
+	if srv, ok := instance.SRV.RR.(*dns.SRV); ok {
+		instance.Host = srv.Target
+		instance.Port = int(srv.Port)
+	} else {
+		instance.Host = ""
+		instance.Port = 0
+	}
+
+	instance.TXT = latest(e.cache.get(instance.RawName, dns.TypeTXT))
+	if txt, ok := instance.TXT.RR.(*dns.TXT); ok {
+		instance.Extras = txt.Txt
+		instance.Attributes = ParseTXT(txt.Txt)
+	} else {
+		instance.Extras = nil
+		instance.Attributes = nil
+	}
+
+	instance.Subtypes = e.subtypesOf(*instance)
+	instance.Records = e.recordsFor(instance.RawName)
+
+	return instance.Host != before.Host || instance.Port != before.Port ||
+		!slices.Equal(instance.Extras, before.Extras) || !slices.Equal(instance.Subtypes, before.Subtypes) ||
+		!recordSetsEqual(instance.Records, before.Records)
+}
+
+// Adds, updates or removes a host according to its A and AAAA records, and any
+// reverse PTRs pointing to it.
+func (e *Engine) syncHost(name string, seen time.Time) {
+	s := &e.state
+	records := append(slices.Clone(e.cache.get(name, dns.TypeA)), e.cache.get(name, dns.TypeAAAA)...)
+	reverse := e.reversePTRsTo(name)
+
+	i := slices.IndexFunc(s.Hosts, func(h Host) bool { return strings.EqualFold(h.Name, name) })
+	if len(records) == 0 && len(reverse) == 0 {
+		if i >= 0 {
+			e.changed(Event{Kind: HostRemoved, Host: s.Hosts[i]})
+			s.Hosts = slices.Delete(s.Hosts, i, i+1)
+		}
+		return
+	}
+
+	added := i < 0
+	if added {
+		var hostName string
+		if len(records) > 0 {
+			hostName = records[0].RR.Header().Name
+		} else {
+			hostName = reverse[0].RR.(*dns.PTR).Ptr
+		}
+		s.Hosts = append(s.Hosts, Host{Name: hostName})
+		i = len(s.Hosts) - 1
+	}
+	host := &s.Hosts[i]
+	before := host.Addresses
+
+	host.Addresses = nil
+	for _, r := range records {
+		addr := HostAddress{
+			Interface: r.Interface,
+			TTL:       r.RR.Header().Ttl,
+			LastSeen:  r.Received,
+			Expires:   r.Expires,
+		}
+		switch rr := r.RR.(type) {
+		case *dns.A:
+			addr.Addr = rr.A.String()
+		case *dns.AAAA:
+			addr.Addr = rr.AAAA.String()
+		}
+		host.Addresses = append(host.Addresses, addr)
+	}
+	for _, r := range reverse {
+		ip, _ := packet.ParseReverseName(r.RR.Header().Name)
+		if host.HasAddr(ip.String()) {
+			continue
+		}
+		host.Addresses = append(host.Addresses, HostAddress{
+			Addr:      ip.String(),
+			Interface: r.Interface,
+			TTL:       r.RR.Header().Ttl,
+			LastSeen:  r.Received,
+			Expires:   r.Expires,
+			Reverse:   true,
+		})
+	}
+	slices.SortStableFunc(host.Addresses, func(a, b HostAddress) int { return cmpBool(!a.IsIPv4(), !b.IsIPv4()) })
+	if !seen.IsZero() {
+		host.LastSeen = seen
+	}
+	host.Records = e.recordsFor(name)
+
+	var absorbed bool
+	i, absorbed = e.upgradeProvisional(i, added)
+	host = &s.Hosts[i]
+
+	sameAddrs := slices.EqualFunc(before, host.Addresses, func(a, b HostAddress) bool {
+		return a.Addr == b.Addr && a.Interface == b.Interface && a.Reverse == b.Reverse
+	})
+	if added {
+		e.changed(Event{Kind: HostAdded, Host: *host})
+	} else if !sameAddrs || absorbed {
+		e.changed(Event{Kind: HostUpdated, Host: *host})
+	}
+}
+
+// Makes sure there is a host for the sender of a query, so that devices that
+// browse for services without announcing any still show up. Until an address
+// record turns up for it, the host is provisional and named after its address.
+// There is no record to say how long a provisional host lasts, so it expires
+// provisionalHostLifetime after the last query it sent.
+func (e *Engine) trackQuerier(p packet.MDNSPacket) {
+	s := &e.state
+	if i := slices.IndexFunc(s.Hosts, func(h Host) bool { return h.HasAddr(p.SrcAddr) }); i >= 0 {
+		if host := &s.Hosts[i]; host.Provisional {
+			host.Addresses = slices.Clone(host.Addresses)
+			for j := range host.Addresses {
+				if host.Addresses[j].Addr == p.SrcAddr {
+					host.Addresses[j].LastSeen = p.Timestamp
+					host.Addresses[j].Expires = p.Timestamp.Add(provisionalHostLifetime)
+				}
+			}
+		}
+		return
+	}
+
+	host := Host{
+		Name:        p.SrcAddr,
+		Provisional: true,
+		Addresses: []HostAddress{{
+			Addr:      p.SrcAddr,
+			Interface: p.Interface,
+			TTL:       uint32(provisionalHostLifetime / time.Second),
+			LastSeen:  p.Timestamp,
+			Expires:   p.Timestamp.Add(provisionalHostLifetime),
+		}},
+		LastSeen: p.Timestamp,
+	}
+	s.Hosts = append(s.Hosts, host)
+	e.changed(Event{Kind: HostAdded, Host: host})
+}
+
+// Replaces any provisional hosts that share an address with the named host at
+// index i, carrying over what we learned about them. A newly added host takes
+// the place of the first provisional host it replaces, so that it keeps its
+// place in the graph. Returns the host's new index, and whether anything was
+// replaced.
+func (e *Engine) upgradeProvisional(i int, added bool) (int, bool) {
+	s := &e.state
+	absorbed := false
+	for j := 0; j < len(s.Hosts); j++ {
+		prov := s.Hosts[j]
+		if !prov.Provisional || !slices.ContainsFunc(prov.Addresses, func(a HostAddress) bool { return s.Hosts[i].HasAddr(a.Addr) }) {
+			continue
+		}
+
+		host := s.Hosts[i]
+		for _, mac := range prov.MACs {
+			if !slices.Contains(host.MACs, mac) {
+				host.MACs = append(host.MACs, mac)
+			}
+		}
+		if prov.LastSeen.After(host.LastSeen) {
+			host.LastSeen = prov.LastSeen
+		}
+		host.OffLinkTTL = utils.OrDefault(host.OffLinkTTL, prov.OffLinkTTL)
+		e.changed(Event{Kind: HostRemoved, Host: prov})
+		absorbed = true
+
+		if added && j < i {
+			s.Hosts[j] = host
+			s.Hosts = slices.Delete(s.Hosts, i, i+1)
+			i = j
+		} else {
+			s.Hosts[i] = host
+			s.Hosts = slices.Delete(s.Hosts, j, j+1)
+			if j < i {
+				i--
+			}
+			j--
+		}
+	}
+	return i, absorbed
+}
+
+// Returns the most recently received record in an rrset, or the zero
+// CachedRecord if it is empty. Ties go to the record that was added last.
+func latest(rrset []CachedRecord) CachedRecord {
+	var res CachedRecord
+	for _, r := range rrset {
+		if res.RR == nil || !r.Received.Before(res.Received) {
+			res = r
+		}
+	}
+	return res
+}
+
+// Updates what we know about the host that sent a packet, using the link and
+// IP layer info from the capture.
+func (e *Engine) trackSender(p packet.MDNSPacket) {
+	s := &e.state
+
+	offLink := p.TTL != 0 && p.TTL != 255
+	if offLink {
+		sender := utils.AppendToSliceIfAbsent(&s.OffLinkSenders, OffLinkSender{Addr: p.SrcAddr}, func(s OffLinkSender) string {
+			return s.Addr
+		})
+		sender.TTL = p.TTL
+		sender.LastSeen = p.Timestamp
+	}
+
+	for i := range s.Hosts {
+		host := &s.Hosts[i]
+		if !host.HasAddr(p.SrcAddr) {
+			continue
+		}
+
+		host.LastSeen = p.Timestamp
+		changed := false
+		if p.SrcMAC != nil && !slices.Contains(host.MACs, p.SrcMAC.String()) {
+			host.MACs = append(host.MACs, p.SrcMAC.String())
+			changed = true
+		}
+		if offLink && host.OffLinkTTL != p.TTL {
+			host.OffLinkTTL = p.TTL
+			changed = true
+		}
+		if host.ProxiedBy != "" {
+			// It's awake again.
+			host.ProxiedBy, host.Owner = "", nil
+			changed = true
+		}
+		if opt := p.DNS.IsEdns0(); opt != nil {
+			edns := parseEDNS(opt, p.Timestamp)
+			changed = changed || host.EDNS == nil || !slices.EqualFunc(host.EDNS.Options, edns.Options, EDNSOption.Equal)
+			host.EDNS = &edns
+		}
+		if changed {
+			e.changed(Event{Kind: HostUpdated, Host: *host})
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package discovery
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/bvisness/buongiorno/src/utils"
+	"github.com/miekg/dns"
+)
+
+// The top bit of a question's class is the unicast-response bit (RFC 6762
+// section 5.4). Questions with it set are QU questions; the rest are QM.
+const unicastResponseBit = 1 << 15
+
+// How long responders may take to answer (RFC 6762 section 6). Answers with
+// shared records, like PTRs, are delayed by 20-120ms to avoid collisions, or
+// 400-500ms if the question was truncated and more known answers are on the
+// way. Answers up to responseGrace after that are still matched, but are late.
+const (
+	responseDelay          = 120 * time.Millisecond
+	truncatedResponseDelay = 500 * time.Millisecond
+	responseGrace          = time.Second
+)
+
+// How long questions are kept around for.
+const questionHistory = 10 * time.Minute
+
+// A question someone asked, and the answers it got.
+type Question struct {
+	Asker     string // the address it came from
+	Interface string
+	Name      string
+	Type      uint16
+	Unicast   bool // the QU bit: a unicast answer is preferred
+	Truncated bool // more known answers followed in other packets
+	Asked     time.Time
+
+	// The answers the asker listed as already known. Responders don't repeat
+	// these (RFC 6762 section 7.1), so the question may go unanswered.
+	KnownAnswers int
+	Answers      []QuestionAnswer
+}
+
+// The first packet a responder sent that answered a question.
+type QuestionAnswer struct {
+	Responder string
+	Received  time.Time
+	Latency   time.Duration
+	Unicast   bool // sent straight to the asker, rather than to the group
+	Late      bool // outside the delay RFC 6762 allows
+}
+
+// How quickly a responder has been answering questions.
+type ResponderLatency struct {
+	Responder     string
+	Answers, Late int
+	Min, Max      time.Duration
+	Total         time.Duration // for the mean
+	LastAnswered  time.Time
+}
+
+// "QU" or "QM", for display.
+func (q Question) Mode() string {
+	if q.Unicast {
+		return "QU"
+	}
+	return "QM"
+}
+
+func (q Question) maxDelay() time.Duration {
+	if q.Truncated {
+		return truncatedResponseDelay
+	}
+	return responseDelay
+}
+
+// Whether a question has had all the time it is going to get to be answered.
+func (q Question) Expired(now time.Time) bool {
+	return now.Sub(q.Asked) > q.maxDelay()+responseGrace
+}
+
+// Whether a record answers a question, either directly or with an NSEC saying
+// there are no records of the type asked for.
+func (q Question) answeredBy(rr dns.RR) bool {
+	hdr := rr.Header()
+	if !strings.EqualFold(hdr.Name, q.Name) {
+		return false
+	}
+	return q.Type == dns.TypeANY || hdr.Rrtype == q.Type || hdr.Rrtype == dns.TypeNSEC
+}
+
+func (l ResponderLatency) Mean() time.Duration {
+	if l.Answers == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Answers)
+}
+
+// Records the questions in a query.
+func (e *Engine) trackQuestions(p packet.MDNSPacket) {
+	if p.DNS.Response {
+		return
+	}
+	for _, question := range p.DNS.Question {
+		e.state.Questions = append(e.state.Questions, Question{
+			Asker:     p.SrcAddr,
+			Interface: p.Interface,
+			Name:      question.Name,
+			Type:      question.Qtype,
+			Unicast:   question.Qclass&unicastResponseBit != 0,
+			Truncated: p.DNS.Truncated,
+			Asked:     p.Timestamp,
+
+			KnownAnswers: len(slices.DeleteFunc(slices.Clone(p.DNS.Answer), func(rr dns.RR) bool {
+				return !strings.EqualFold(rr.Header().Name, question.Name)
+			})),
+		})
+	}
+}
+
+// Matches the records in a response to the open questions they answer. An
+// answer sent by unicast only answers the questions of the address it was
+// sent to.
+func (e *Engine) trackAnswers(p packet.MDNSPacket) {
+	s := &e.state
+	if !p.DNS.Response {
+		return
+	}
+	records := append(slices.Clone(p.DNS.Answer), p.DNS.Extra...)
+
+	// Questions are in the order they were asked, so only the last few can
+	// still be open.
+	for i := len(s.Questions) - 1; i >= 0; i-- {
+		q := &s.Questions[i]
+		if p.Timestamp.Sub(q.Asked) > truncatedResponseDelay+responseGrace {
+			break
+		}
+		if q.Expired(p.Timestamp) || q.Asker == p.SrcAddr || p.Timestamp.Before(q.Asked) {
+			continue
+		}
+		if (!p.Multicast && p.DstAddr != q.Asker) || (p.Interface != "" && q.Interface != "" && p.Interface != q.Interface) {
+			continue
+		}
+		if slices.ContainsFunc(q.Answers, func(a QuestionAnswer) bool { return a.Responder == p.SrcAddr }) {
+			continue
+		}
+		if !slices.ContainsFunc(records, q.answeredBy) {
+			continue
+		}
+
+		answer := QuestionAnswer{
+			Responder: p.SrcAddr,
+			Received:  p.Timestamp,
+			Latency:   p.Timestamp.Sub(q.Asked),
+			Unicast:   !p.Multicast,
+		}
+		answer.Late = answer.Latency > q.maxDelay()
+		q.Answers = append(q.Answers, answer)
+		e.trackLatency(answer)
+	}
+}
+
+func (e *Engine) trackLatency(answer QuestionAnswer) {
+	s := &e.state
+	l := utils.AppendToSliceIfAbsent(&s.Latencies, ResponderLatency{Responder: answer.Responder}, func(l ResponderLatency) string {
+		return l.Responder
+	})
+	if l.Answers == 0 || answer.Latency < l.Min {
+		l.Min = answer.Latency
+	}
+	l.Max = max(l.Max, answer.Latency)
+	l.Total += answer.Latency
+	l.Answers++
+	if answer.Late {
+		l.Late++
+	}
+	l.LastAnswered = answer.Received
+}
+
+// Drops questions older than questionHistory.
+func (e *Engine) expireQuestions(now time.Time) {
+	s := &e.state
+	i := slices.IndexFunc(s.Questions, func(q Question) bool { return now.Sub(q.Asked) <= questionHistory })
+	if i < 0 {
+		i = len(s.Questions)
+	}
+	if i > 0 {
+		s.Questions = slices.Clone(s.Questions[i:])
+	}
+}
+
+// The questions whose time to be answered has run out without any answers,
+// other than those the asker already knew answers to.
+func (s *State) UnansweredQuestions() []Question {
+	var res []Question
+	for _, q := range s.Questions {
+		if len(q.Answers) == 0 && q.KnownAnswers == 0 && q.Expired(s.Now) {
+			res = append(res, q)
+		}
+	}
+	return res
+}
+
+func (s *State) LatencyForResponder(addr string) (ResponderLatency, bool) {
+	i := slices.IndexFunc(s.Latencies, func(l ResponderLatency) bool { return l.Responder == addr })
+	if i < 0 {
+		return ResponderLatency{}, false
+	}
+	return s.Latencies[i], true
+}
@@ -0,0 +1,82 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeAnswer(service string, ip net.IP, delay time.Duration) packet.MDNSPacket {
+	p := makeAdvertisement("MacBook", service, "MacBook", ip)
+	p.Timestamp = testTime.Add(delay)
+	p.Multicast = true
+	return p
+}
+
+func TestQuestions(t *testing.T) {
+	e := NewEngine()
+	macbook := net.IPv4(192, 168, 1, 10)
+
+	airplay := makeQuery("192.168.1.20", "_airplay._tcp")
+	raop := makeQuery("192.168.1.20", "_raop._tcp")
+	raop.DNS.Question[0].Qclass |= unicastResponseBit
+	raop.Timestamp = testTime.Add(10 * time.Millisecond)
+	e.HandlePacket(airplay)
+	e.HandlePacket(raop)
+
+	// Unicast to someone else, so it doesn't count
+	unicast := makeAnswer("_airplay._tcp", macbook, 20*time.Millisecond)
+	unicast.Multicast, unicast.DstAddr = false, "192.168.1.30"
+	e.HandlePacket(unicast)
+
+	e.HandlePacket(makeAnswer("_airplay._tcp", macbook, 50*time.Millisecond))
+	e.HandlePacket(makeAnswer("_airplay._tcp", macbook, 60*time.Millisecond)) // only the first answer counts
+
+	// The same question again, with the answer already known
+	known := makeQuery("192.168.1.20", "_airplay._tcp")
+	known.Timestamp = testTime.Add(time.Second)
+	known.DNS.Answer = []dns.RR{makePTR("_airplay._tcp.local.", "MacBook._airplay._tcp.local.", 4500)}
+	e.HandlePacket(known)
+
+	// And once more, answered slowly
+	slow := makeQuery("192.168.1.20", "_airplay._tcp")
+	slow.Timestamp = testTime.Add(2 * time.Second)
+	e.HandlePacket(slow)
+	e.HandlePacket(makeAnswer("_airplay._tcp", macbook, 2*time.Second+300*time.Millisecond))
+
+	e.Expire(testTime.Add(5 * time.Second))
+	state := e.Snapshot()
+	if !assert.Equal(t, 4, len(state.Questions)) {
+		return
+	}
+
+	q := state.Questions[0]
+	assert.Equal(t, "QM", q.Mode())
+	if assert.Equal(t, 1, len(q.Answers)) {
+		assert.Equal(t, "192.168.1.10", q.Answers[0].Responder)
+		assert.Equal(t, 50*time.Millisecond, q.Answers[0].Latency)
+		assert.False(t, q.Answers[0].Late)
+	}
+	assert.Equal(t, "QU", state.Questions[1].Mode())
+	assert.Equal(t, 1, state.Questions[2].KnownAnswers)
+	if assert.Equal(t, 1, len(state.Questions[3].Answers)) {
+		assert.True(t, state.Questions[3].Answers[0].Late)
+	}
+
+	unanswered := state.UnansweredQuestions()
+	if assert.Equal(t, 1, len(unanswered)) {
+		assert.Equal(t, "_raop._tcp.local.", unanswered[0].Name)
+	}
+
+	if l, ok := state.LatencyForResponder("192.168.1.10"); assert.True(t, ok) {
+		assert.Equal(t, 2, l.Answers)
+		assert.Equal(t, 1, l.Late)
+		assert.Equal(t, 50*time.Millisecond, l.Min)
+		assert.Equal(t, 300*time.Millisecond, l.Max)
+		assert.Equal(t, 175*time.Millisecond, l.Mean())
+	}
+}
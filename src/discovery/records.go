@@ -0,0 +1,166 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The records we have for a host or instance beyond the ones that make it up:
+// NSEC, HINFO, and any types we don't otherwise interpret. Sorted by type.
+type RecordSet []CachedRecord
+
+// The NSEC record for the name, if any. In mDNS, an NSEC says which types of
+// record a name has, and so which types it definitely doesn't (RFC 6762
+// section 6.1).
+func (r RecordSet) NSEC() (*dns.NSEC, bool) {
+	for _, record := range r {
+		if nsec, ok := record.RR.(*dns.NSEC); ok {
+			return nsec, true
+		}
+	}
+	return nil, false
+}
+
+func (r RecordSet) HINFO() (*dns.HINFO, bool) {
+	for _, record := range r {
+		if hinfo, ok := record.RR.(*dns.HINFO); ok {
+			return hinfo, true
+		}
+	}
+	return nil, false
+}
+
+// Whether an NSEC record says the name has no records of a type.
+func (r RecordSet) Lacks(rrtype uint16) bool {
+	nsec, ok := r.NSEC()
+	return ok && !slices.Contains(nsec.TypeBitMap, rrtype)
+}
+
+// Everything other than NSEC and HINFO.
+func (r RecordSet) Other() RecordSet {
+	return slices.DeleteFunc(slices.Clone(r), func(record CachedRecord) bool {
+		t := record.RR.Header().Rrtype
+		return t == dns.TypeNSEC || t == dns.TypeHINFO
+	})
+}
+
+func recordSetsEqual(a, b RecordSet) bool {
+	return slices.EqualFunc(a, b, func(a, b CachedRecord) bool { return dns.IsDuplicate(a.RR, b.RR) })
+}
+
+// Whether we interpret a type of record ourselves, rather than just keeping it
+// in a RecordSet.
+func isInterpretedType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypePTR, dns.TypeSRV, dns.TypeTXT, dns.TypeA, dns.TypeAAAA:
+		return true
+	}
+	return false
+}
+
+// Returns the uninterpreted records in the cache for a name.
+func (e *Engine) recordsFor(name string) RecordSet {
+	name = strings.ToLower(name)
+	var res RecordSet
+	for key, rrset := range e.cache.rrsets {
+		if key.Name == name && !isInterpretedType(key.Type) {
+			res = append(res, rrset...)
+		}
+	}
+	slices.SortStableFunc(res, func(a, b CachedRecord) int {
+		return int(a.RR.Header().Rrtype) - int(b.RR.Header().Rrtype)
+	})
+	return res
+}
+
+// Updates the records of any host or instance with the given name.
+func (e *Engine) syncRecords(name string) {
+	s := &e.state
+	records := e.recordsFor(name)
+	for i := range s.Hosts {
+		host := &s.Hosts[i]
+		if !strings.EqualFold(host.Name, name) {
+			continue
+		}
+		changed := !recordSetsEqual(host.Records, records)
+		host.Records = records
+		if changed {
+			e.changed(Event{Kind: HostUpdated, Host: *host})
+		}
+	}
+	if i := e.instanceIndex(name); i >= 0 {
+		instance := &s.ServiceInstances[i]
+		changed := !recordSetsEqual(instance.Records, records)
+		instance.Records = records
+		if changed {
+			e.changed(Event{Kind: InstanceUpdated, Instance: *instance})
+		}
+	}
+}
+
+// EDNS(0) data from the OPT pseudo-record (RFC 6891) in a packet.
+type EDNS struct {
+	UDPSize  uint16
+	Options  []EDNSOption
+	Received time.Time
+}
+
+type EDNSOption struct {
+	Code uint16
+	Data []byte // the raw option data, for options miekg/dns doesn't know
+	Text string // as miekg/dns formats it
+}
+
+// The EDNS0 Owner option (draft-cheshire-edns0-owner-option), which sleep
+// proxy clients use to say who they are. miekg/dns knows this code as the ENUM
+// Source-URI option (EDNS0ESU), which never appears in mDNS.
+const ednsOwnerOption = 4
+
+// Names for the options we are likely to see in mDNS.
+var ednsOptionNames = map[uint16]string{
+	dns.EDNS0UL:      "Update lease",
+	dns.EDNS0NSID:    "NSID",
+	ednsOwnerOption:  "Owner",
+	dns.EDNS0SUBNET:  "Client subnet",
+	dns.EDNS0COOKIE:  "Cookie",
+	dns.EDNS0PADDING: "Padding",
+}
+
+func (o EDNSOption) Equal(other EDNSOption) bool {
+	return o.Code == other.Code && bytes.Equal(o.Data, other.Data) && o.Text == other.Text
+}
+
+func (o EDNSOption) Name() string {
+	if name, ok := ednsOptionNames[o.Code]; ok {
+		return name
+	}
+	return fmt.Sprintf("Option %d", o.Code)
+}
+
+func (o EDNSOption) String() string {
+	if o.Data != nil {
+		return fmt.Sprintf("%s: %s", o.Name(), hex.EncodeToString(o.Data))
+	}
+	return fmt.Sprintf("%s: %s", o.Name(), o.Text)
+}
+
+func parseEDNS(opt *dns.OPT, received time.Time) EDNS {
+	res := EDNS{UDPSize: opt.UDPSize(), Received: received}
+	for _, option := range opt.Option {
+		o := EDNSOption{Code: option.Option(), Text: option.String()}
+		switch option := option.(type) {
+		case *dns.EDNS0_LOCAL:
+			o.Data = option.Data
+		case *dns.EDNS0_ESU:
+			o.Data = []byte(option.Uri) // really the owner option
+		}
+		res.Options = append(res.Options, o)
+	}
+	return res
+}
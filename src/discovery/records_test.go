@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecords(t *testing.T) {
+	e := NewEngine()
+	p := makeAdvertisement("Printer", "_ipp._tcp", "Printer", net.IPv4(192, 168, 1, 9))
+	p.DNS.Extra = append(p.DNS.Extra,
+		// The host has an A record and nothing else, so definitely no AAAA.
+		&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "Printer.local.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET | cacheFlushBit, Ttl: 120},
+			NextDomain: "Printer.local.",
+			TypeBitMap: []uint16{dns.TypeA},
+		},
+		&dns.HINFO{
+			Hdr: dns.RR_Header{Name: "Printer.local.", Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 120},
+			Cpu: "ARM", Os: "ThreadX",
+		},
+		&dns.RFC3597{
+			Hdr:   dns.RR_Header{Name: "Printer._ipp._tcp.local.", Rrtype: 65280, Class: dns.ClassINET, Ttl: 120},
+			Rdata: "abcd",
+		},
+	)
+	p.DNS.SetEdns0(1440, false)
+	opt := p.DNS.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_ESU{Code: dns.EDNS0ESU, Uri: "\x00\x00\xa6\xd9\x07\xaa\xac\x61"})
+
+	// Round-trip through the wire format, as a real packet would.
+	packed, err := p.DNS.Pack()
+	if !assert.Nil(t, err) {
+		return
+	}
+	p.DNS = dns.Msg{}
+	if !assert.Nil(t, p.DNS.Unpack(packed)) {
+		return
+	}
+	e.HandlePacket(p)
+
+	state := e.Snapshot()
+	host := state.Hosts[0]
+	assert.True(t, host.Records.Lacks(dns.TypeAAAA))
+	assert.False(t, host.Records.Lacks(dns.TypeA))
+	if hinfo, ok := host.Records.HINFO(); assert.True(t, ok) {
+		assert.Equal(t, "ARM", hinfo.Cpu)
+		assert.Equal(t, "ThreadX", hinfo.Os)
+	}
+	assert.Empty(t, host.Records.Other())
+
+	if assert.NotNil(t, host.EDNS) {
+		assert.Equal(t, uint16(1440), host.EDNS.UDPSize)
+		if assert.Equal(t, 1, len(host.EDNS.Options)) {
+			assert.Equal(t, "Owner: 0000a6d907aaac61", host.EDNS.Options[0].String())
+		}
+	}
+
+	instance := state.ServiceInstances[0]
+	assert.False(t, instance.Records.Lacks(dns.TypeSRV)) // no NSEC, so we don't know
+	if other := instance.Records.Other(); assert.Equal(t, 1, len(other)) {
+		assert.Equal(t, uint16(65280), other[0].RR.Header().Rrtype)
+	}
+}
@@ -0,0 +1,114 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/miekg/dns"
+)
+
+// A reverse-mapping PTR, like 5.1.168.192.in-addr.arpa -> MacBook-Pro-3.local,
+// which ties an address to a host name even if we never see an A record for it.
+type ReversePTR struct {
+	Addr string // the address the PTR's name is for
+	Host string // the host name it points to
+
+	PTR CachedRecord
+}
+
+// Returns the reverse PTRs in the cache that point to a host name.
+func (e *Engine) reversePTRsTo(name string) []CachedRecord {
+	var res []CachedRecord
+	for key, rrset := range e.cache.rrsets {
+		if key.Type != dns.TypePTR {
+			continue
+		}
+		if _, ok := packet.ParseReverseName(key.Name); !ok {
+			continue
+		}
+		for _, r := range rrset {
+			if strings.EqualFold(r.RR.(*dns.PTR).Ptr, name) {
+				res = append(res, r)
+			}
+		}
+	}
+	slices.SortFunc(res, func(a, b CachedRecord) int { return strings.Compare(a.RR.Header().Name, b.RR.Header().Name) })
+	return res
+}
+
+// Replaces the reverse PTRs for a name with the ones in the cache, and updates
+// the hosts they pointed to before and point to now.
+func (e *Engine) syncReverse(name string, seen time.Time) {
+	s := &e.state
+	ip, _ := packet.ParseReverseName(name)
+
+	var before []string
+	s.ReversePTRs = slices.DeleteFunc(slices.Clone(s.ReversePTRs), func(r ReversePTR) bool {
+		if !strings.EqualFold(r.PTR.RR.Header().Name, name) {
+			return false
+		}
+		before = append(before, r.Host)
+		return true
+	})
+	var after []string
+	for _, ptr := range e.cache.get(name, dns.TypePTR) {
+		host := ptr.RR.(*dns.PTR).Ptr
+		s.ReversePTRs = append(s.ReversePTRs, ReversePTR{Addr: ip.String(), Host: host, PTR: ptr})
+		after = append(after, host)
+	}
+
+	for _, host := range after {
+		e.syncHost(host, seen)
+	}
+	for _, host := range before {
+		if !slices.ContainsFunc(after, func(h string) bool { return strings.EqualFold(h, host) }) {
+			e.syncHost(host, time.Time{})
+		}
+	}
+}
+
+// The reverse PTRs that point to a host.
+func (s *State) ReversePTRsForHost(host Host) []ReversePTR {
+	var res []ReversePTR
+	for _, r := range s.ReversePTRs {
+		if strings.EqualFold(r.Host, host.Name) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// Describes the ways a reverse PTR disagrees with the forward A and AAAA
+// records we have, or with other reverse PTRs for the same address.
+func (s *State) ReverseConflicts(r ReversePTR) []string {
+	ipv4 := net.ParseIP(r.Addr).To4() != nil
+	recordType := "AAAA"
+	if ipv4 {
+		recordType = "A"
+	}
+
+	var res []string
+	for _, host := range s.Hosts {
+		forward := slices.DeleteFunc(slices.Clone(host.Addresses), func(a HostAddress) bool {
+			return a.Reverse || a.IsIPv4() != ipv4
+		})
+		hasAddr := slices.ContainsFunc(forward, func(a HostAddress) bool { return a.Addr == r.Addr })
+		if strings.EqualFold(host.Name, r.Host) {
+			if len(forward) > 0 && !hasAddr {
+				res = append(res, fmt.Sprintf("%s's %s records don't include %s", host.Name, recordType, r.Addr))
+			}
+		} else if hasAddr {
+			res = append(res, fmt.Sprintf("%s is in the %s records for %s", r.Addr, recordType, host.Name))
+		}
+	}
+	for _, other := range s.ReversePTRs {
+		if other.Addr == r.Addr && !strings.EqualFold(other.Host, r.Host) {
+			res = append(res, fmt.Sprintf("%s also points to %s", other.PTR.RR.Header().Name, other.Host))
+		}
+	}
+	return res
+}
@@ -0,0 +1,65 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeReverse(src string, ptrs ...*dns.PTR) packet.MDNSPacket {
+	var msg dns.Msg
+	msg.Response = true
+	for _, ptr := range ptrs {
+		msg.Answer = append(msg.Answer, ptr)
+	}
+	return packet.MDNSPacket{Timestamp: testTime, SrcAddr: src, SrcPort: 5353, TTL: 255, DNS: msg}
+}
+
+func TestReversePTRs(t *testing.T) {
+	e := NewEngine()
+	e.HandlePacket(makeReverse("192.168.1.9",
+		makePTR("9.1.168.192.in-addr.arpa.", "Printer.local.", 120),
+		makePTR("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.", "Printer.local.", 120),
+	))
+
+	state := e.Snapshot()
+	if assert.Equal(t, 1, len(state.Hosts)) {
+		host := state.Hosts[0]
+		assert.Equal(t, "Printer.local.", host.Name)
+		assert.Equal(t, "192.168.1.9", host.IPv4Addr())
+		assert.Equal(t, "fe80::1", host.IPv6Addr())
+		assert.True(t, host.Addresses[0].Reverse)
+	}
+	for _, r := range state.ReversePTRs {
+		assert.Empty(t, state.ReverseConflicts(r))
+	}
+
+	// The A record agrees with the PTR.
+	e.HandlePacket(makeAdvertisement("Printer", "_ipp._tcp", "Printer", net.IPv4(192, 168, 1, 9)))
+	state = e.Snapshot()
+	assert.False(t, state.Hosts[0].Addresses[0].Reverse)
+	assert.Equal(t, 2, len(state.Hosts[0].Addresses))
+
+	// But this one doesn't agree with anything.
+	e.HandlePacket(makeAdvertisement("MacBook", "_airplay._tcp", "MacBook", net.IPv4(192, 168, 1, 5)))
+	e.HandlePacket(makeReverse("192.168.1.9", makePTR("5.1.168.192.in-addr.arpa.", "Printer.local.", 120)))
+	state = e.Snapshot()
+	reverse := state.ReversePTRsForHost(state.Hosts[0])
+	if assert.Equal(t, 3, len(reverse)) {
+		i := len(reverse) - 1
+		assert.Equal(t, "192.168.1.5", reverse[i].Addr)
+		assert.Equal(t, []string{
+			"Printer.local.'s A records don't include 192.168.1.5",
+			"192.168.1.5 is in the A records for MacBook.local.",
+		}, state.ReverseConflicts(reverse[i]))
+	}
+
+	// A host we only know from reverse PTRs goes away with them.
+	e.HandlePacket(makeReverse("192.168.1.20", makePTR("20.1.168.192.in-addr.arpa.", "Phone.local.", 120)))
+	assert.Equal(t, 3, len(e.Snapshot().Hosts))
+	e.HandlePacket(makeReverse("192.168.1.20", makePTR("20.1.168.192.in-addr.arpa.", "Phone.local.", 0)))
+	assert.Equal(t, 2, len(e.Snapshot().Hosts))
+}
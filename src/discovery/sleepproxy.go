@@ -0,0 +1,136 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/miekg/dns"
+)
+
+// The EDNS0 Owner option (draft-cheshire-edns0-owner-option), which Apple
+// devices put in their announcements, and which a Bonjour Sleep Proxy keeps
+// sending on their behalf while they sleep.
+type OwnerOption struct {
+	Version  uint8
+	Sequence uint8 // incremented every time the owner wakes up
+
+	PrimaryMAC net.HardwareAddr
+	WakeupMAC  net.HardwareAddr // the MAC to send a wake-up packet to
+	Password   []byte           // for the wake-up packet, if any
+}
+
+// Parses the data of an Owner option. The primary MAC is required; the wakeup
+// MAC and password are optional, and the wakeup MAC defaults to the primary.
+func ParseOwnerOption(data []byte) (OwnerOption, bool) {
+	if len(data) < 8 {
+		return OwnerOption{}, false
+	}
+	res := OwnerOption{
+		Version:    data[0],
+		Sequence:   data[1],
+		PrimaryMAC: net.HardwareAddr(slices.Clone(data[2:8])),
+	}
+	res.WakeupMAC = res.PrimaryMAC
+	if len(data) >= 14 {
+		res.WakeupMAC = net.HardwareAddr(slices.Clone(data[8:14]))
+	}
+	if len(data) > 14 {
+		res.Password = slices.Clone(data[14:])
+	}
+	return res, true
+}
+
+func (o OwnerOption) String() string {
+	res := fmt.Sprintf("%s, sequence %d", o.PrimaryMAC, o.Sequence)
+	if !bytes.Equal(o.WakeupMAC, o.PrimaryMAC) {
+		res += fmt.Sprintf(", wake %s", o.WakeupMAC)
+	}
+	if o.Password != nil {
+		res += ", with password"
+	}
+	return res
+}
+
+func (e EDNS) Owner() (OwnerOption, bool) {
+	for _, option := range e.Options {
+		if option.Code == ednsOwnerOption {
+			return ParseOwnerOption(option.Data)
+		}
+	}
+	return OwnerOption{}, false
+}
+
+// Notices when a packet was sent by a sleep proxy on behalf of another host:
+// its Owner option names a MAC address other than the sender's. The hosts it
+// is answering for are those with the owner's MAC, or whose address records
+// are in the packet.
+func (e *Engine) trackSleepProxy(p packet.MDNSPacket, touched []recordKey) {
+	s := &e.state
+	opt := p.DNS.IsEdns0()
+	if opt == nil {
+		return
+	}
+	owner, ok := parseEDNS(opt, p.Timestamp).Owner()
+	if !ok {
+		return
+	}
+	ownerMAC := owner.PrimaryMAC.String()
+
+	if p.SrcMAC != nil {
+		if bytes.Equal(p.SrcMAC, owner.PrimaryMAC) {
+			return
+		}
+	} else if slices.ContainsFunc(s.Hosts, func(h Host) bool { return h.HasAddr(p.SrcAddr) && slices.Contains(h.MACs, ownerMAC) }) {
+		// Without the link layer we can only go by the MACs we already know.
+		return
+	}
+
+	for i := range s.Hosts {
+		host := &s.Hosts[i]
+		if host.HasAddr(p.SrcAddr) {
+			continue // the proxy itself
+		}
+		inPacket := slices.ContainsFunc(touched, func(key recordKey) bool {
+			return (key.Type == dns.TypeA || key.Type == dns.TypeAAAA) && strings.EqualFold(key.Name, host.Name)
+		})
+		if !inPacket && !slices.Contains(host.MACs, ownerMAC) {
+			continue
+		}
+
+		changed := host.ProxiedBy != p.SrcAddr
+		host.ProxiedBy = p.SrcAddr
+		host.Owner = &owner
+		if changed {
+			e.changed(Event{Kind: HostUpdated, Host: *host})
+		}
+	}
+}
+
+// Returns the device of the sleep proxy that is answering for a host. If we
+// don't know a host with the proxy's address, but there is exactly one device
+// advertising _sleep-proxy._udp, it must be that one.
+func (s *State) SleepProxyDevice(host Host) (Device, bool) {
+	if host.ProxiedBy == "" {
+		return Device{}, false
+	}
+	if d, ok := s.DeviceForAddr(host.ProxiedBy); ok {
+		return d, true
+	}
+
+	var proxies []Device
+	for _, d := range s.Devices {
+		if slices.ContainsFunc(s.ServiceInstancesForDevice(d), func(i ServiceInstance) bool {
+			return strings.EqualFold(i.ServiceType, "_sleep-proxy._udp")
+		}) {
+			proxies = append(proxies, d)
+		}
+	}
+	if len(proxies) == 1 {
+		return proxies[0], true
+	}
+	return Device{}, false
+}
@@ -0,0 +1,74 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOwnerOption(t *testing.T) {
+	_, ok := ParseOwnerOption([]byte{0, 1, 2, 3})
+	assert.False(t, ok)
+
+	owner, ok := ParseOwnerOption([]byte{0, 7, 0xa6, 0xd9, 0x07, 0xaa, 0xac, 0x61})
+	if assert.True(t, ok) {
+		assert.Equal(t, uint8(7), owner.Sequence)
+		assert.Equal(t, "a6:d9:07:aa:ac:61", owner.PrimaryMAC.String())
+		assert.Equal(t, "a6:d9:07:aa:ac:61", owner.WakeupMAC.String())
+		assert.Nil(t, owner.Password)
+	}
+
+	owner, ok = ParseOwnerOption([]byte{0, 7, 0xa6, 0xd9, 0x07, 0xaa, 0xac, 0x61, 0xa6, 0xd9, 0x07, 0xaa, 0xac, 0x62, 1, 2, 3, 4})
+	if assert.True(t, ok) {
+		assert.Equal(t, "a6:d9:07:aa:ac:61", owner.PrimaryMAC.String())
+		assert.Equal(t, "a6:d9:07:aa:ac:62", owner.WakeupMAC.String())
+		assert.Equal(t, []byte{1, 2, 3, 4}, owner.Password)
+	}
+}
+
+func withOwner(p packet.MDNSPacket, mac net.HardwareAddr) packet.MDNSPacket {
+	p.DNS.SetEdns0(1440, false)
+	opt := p.DNS.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_ESU{Code: dns.EDNS0ESU, Uri: string(append([]byte{0, 1}, mac...))})
+	return p
+}
+
+func TestSleepProxy(t *testing.T) {
+	e := NewEngine()
+	macbookIP := net.IPv4(192, 168, 1, 10)
+	macbook := makeAdvertisement("MacBook", "_airplay._tcp", "MacBook", macbookIP)
+	e.HandlePacket(withOwner(macbook, macbook.SrcMAC))
+
+	proxy := makeAdvertisement("70-35-60-63.1 Apple TV", "_sleep-proxy._udp", "Apple-TV", net.IPv4(192, 168, 1, 5))
+	proxy.SrcMAC = net.HardwareAddr{0x3c, 0x22, 0xfb, 0x01, 0x02, 0x03}
+	e.HandlePacket(proxy)
+
+	state := e.Snapshot()
+	assert.Equal(t, "", state.Hosts[0].ProxiedBy, "the MacBook's own announcement doesn't make it proxied")
+
+	// The MacBook goes to sleep, and the Apple TV takes over its records.
+	proxied := makeAdvertisement("MacBook", "_airplay._tcp", "MacBook", macbookIP)
+	proxied.SrcAddr, proxied.SrcMAC = proxy.SrcAddr, proxy.SrcMAC
+	e.HandlePacket(withOwner(proxied, macbook.SrcMAC))
+
+	state = e.Snapshot()
+	host := state.Hosts[0]
+	assert.Equal(t, "MacBook.local.", host.Name)
+	assert.Equal(t, "192.168.1.5", host.ProxiedBy)
+	if assert.NotNil(t, host.Owner) {
+		assert.Equal(t, "a6:d9:07:aa:ac:61", host.Owner.PrimaryMAC.String())
+	}
+	assert.Equal(t, "", state.Hosts[1].ProxiedBy, "the proxy isn't proxied itself")
+	if d, ok := state.SleepProxyDevice(host); assert.True(t, ok) {
+		assert.True(t, d.HasHost("Apple-TV.local."))
+	}
+
+	// It wakes up again.
+	e.HandlePacket(macbook)
+	state = e.Snapshot()
+	assert.Equal(t, "", state.Hosts[0].ProxiedBy)
+	assert.Nil(t, state.Hosts[0].Owner)
+}
@@ -0,0 +1,237 @@
+package discovery
+
+import (
+	"net"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type ServiceInstance struct {
+	InstanceName string
+	ServiceType  string // the raw DNS-SD service type, e.g. _airplay._tcp
+	Domain       string // should always be "local" for this project
+
+	Host string // Optional. Will be filled in by a corresponding SRV record.
+	Port int    // Optional. Will be filled in by a corresponding SRV record.
+
+	Extras     []string  // May be filled in by a corresponding TXT record.
+	Attributes TXTRecord // Extras, parsed. Nil if there is no TXT record.
+
+	// Other records with the instance's name, like NSEC.
+	Records RecordSet
+
+	// The subtypes the instance is advertised under, e.g. _universal for a
+	// printer with a PTR from _universal._sub._ipp._tcp.local (RFC 6763
+	// section 7.1).
+	Subtypes []string
+
+	RawName  string    // the raw Service Instance Name from the PTR record
+	LastSeen time.Time // when we last saw a record for this instance
+
+	// The records this instance was built from. The instance goes away when
+	// its PTR expires; SRV and TXT are zero if we don't have them (anymore).
+	PTR, SRV, TXT CachedRecord
+}
+
+// How fresh the advertisement for this instance is, from 1 (fresh) to 0
+// (about to expire). See CachedRecord.Freshness.
+func (i ServiceInstance) Freshness(now time.Time) float64 {
+	return i.PTR.Freshness(now)
+}
+
+type Host struct {
+	Name string
+	// All the addresses we know for this host, IPv4 first. Hosts that came
+	// from A and AAAA records go away when the last of these expires.
+	Addresses []HostAddress
+
+	MACs     []string  // the MAC addresses this host has sent packets from
+	LastSeen time.Time // when we last saw a record for, or packet from, this host
+	// RFC 6762 requires mDNS packets to be sent with an IP TTL of 255, so that
+	// receivers can tell they came from the local link. If this host ever sent
+	// us something else, this is the TTL it used.
+	OffLinkTTL int
+
+	// Other records with the host's name, like NSEC and HINFO.
+	Records RecordSet
+	// The EDNS(0) options in the last packet the host sent that had any.
+	EDNS *EDNS
+
+	// Set while a Bonjour Sleep Proxy is answering for this host because it is
+	// asleep: the proxy's address, and the Owner option it sent on the host's
+	// behalf. Cleared as soon as the host sends something itself.
+	ProxiedBy string
+	Owner     *OwnerOption
+
+	// Set for hosts we have only seen sending queries, which are named after
+	// their address. They are replaced by the real host once an A or AAAA
+	// record with their address arrives, and expire a few minutes after the
+	// last query they sent.
+	Provisional bool
+}
+
+type HostAddress struct {
+	Addr      string
+	Interface string // the interface the address was advertised on, if known
+
+	// From the A or AAAA record. Addresses that didn't come from records, like
+	// our own, have a TTL of zero and never expire.
+	TTL      uint32
+	LastSeen time.Time // when the record was last received
+	Expires  time.Time
+
+	// Only known from a reverse PTR (e.g. 5.1.168.192.in-addr.arpa), not an
+	// A or AAAA record. The rest of the fields are from the PTR.
+	Reverse bool
+}
+
+func (a HostAddress) IsIPv4() bool {
+	ip := net.ParseIP(a.Addr)
+	return ip != nil && ip.To4() != nil
+}
+
+// See CachedRecord.Freshness.
+func (a HostAddress) Freshness(now time.Time) float64 {
+	return freshness(a.LastSeen, a.Expires, now)
+}
+
+func (h Host) HasAddr(addr string) bool {
+	return slices.ContainsFunc(h.Addresses, func(a HostAddress) bool { return a.Addr == addr })
+}
+
+// The first address of each kind, for when there's only room for one.
+func (h Host) IPv4Addr() string {
+	if i := slices.IndexFunc(h.Addresses, HostAddress.IsIPv4); i >= 0 {
+		return h.Addresses[i].Addr
+	}
+	return ""
+}
+
+func (h Host) IPv6Addr() string {
+	if i := slices.IndexFunc(h.Addresses, func(a HostAddress) bool { return !a.IsIPv4() }); i >= 0 {
+		return h.Addresses[i].Addr
+	}
+	return ""
+}
+
+// How fresh the host's freshest address is, from 1 (fresh) to 0 (about to
+// expire). See CachedRecord.Freshness.
+func (h Host) Freshness(now time.Time) float64 {
+	if len(h.Addresses) == 0 {
+		return 1
+	}
+	res := 0.0
+	for _, a := range h.Addresses {
+		res = max(res, a.Freshness(now))
+	}
+	return res
+}
+
+// A sender whose packets had an IP TTL other than 255. These either came from
+// beyond the local link (e.g. via a misconfigured router) or from a broken mDNS
+// implementation.
+type OffLinkSender struct {
+	Addr     string
+	TTL      int
+	LastSeen time.Time
+}
+
+type ServiceQuery struct {
+	SourceAddr  string
+	ServiceType string // the raw DNS-SD service type, e.g. _airplay._tcp
+
+	RawQuery string
+}
+
+// Everything an Engine has learned about the network from the packets it has
+// seen.
+type State struct {
+	ServiceInstances []ServiceInstance
+	Hosts            []Host
+	ServiceQueries   []ServiceQuery
+	OffLinkSenders   []OffLinkSender
+
+	// The service types each responder says it offers.
+	ServiceTypes []AdvertisedServiceType
+
+	// Domains suggested for browsing and registering services in.
+	BrowseDomains []BrowseDomain
+
+	// Reverse-mapping PTRs, from addresses back to host names. These also
+	// add addresses to hosts; see ReverseConflicts for when they disagree.
+	ReversePTRs []ReversePTR
+
+	// Recent questions, in the order they were asked, with the answers they
+	// got, and how quickly each responder has been answering.
+	Questions []Question
+	Latencies []ResponderLatency
+
+	// The hosts grouped into physical devices. Every host is in exactly one
+	// device.
+	Devices []Device
+
+	// SRV and TXT records for instances we have not seen a PTR for (yet).
+	DeferredRRs []dns.RR
+
+	// The time of the latest packet, or of the last call to Engine.Expire.
+	// Use this rather than the wall clock to judge the freshness of records,
+	// since packets may come from a capture file.
+	Now time.Time
+}
+
+// Returns a copy of the state that can be read while the original continues to
+// be updated.
+//
+// This is a shallow copy, so updates must never modify the elements of a
+// nested slice in place (e.g. Host.MACs). Appending to them, or replacing them
+// outright, is fine.
+func (s *State) Clone() State {
+	return State{
+		ServiceInstances: slices.Clone(s.ServiceInstances),
+		Hosts:            slices.Clone(s.Hosts),
+		ServiceQueries:   slices.Clone(s.ServiceQueries),
+		OffLinkSenders:   slices.Clone(s.OffLinkSenders),
+		ServiceTypes:     slices.Clone(s.ServiceTypes),
+		BrowseDomains:    slices.Clone(s.BrowseDomains),
+		ReversePTRs:      slices.Clone(s.ReversePTRs),
+		Questions:        slices.Clone(s.Questions),
+		Latencies:        slices.Clone(s.Latencies),
+		Devices:          slices.Clone(s.Devices),
+		DeferredRRs:      slices.Clone(s.DeferredRRs),
+		Now:              s.Now,
+	}
+}
+
+func (s *State) ServiceQueriesForHost(host Host) []ServiceQuery {
+	return s.serviceQueriesFrom(host.HasAddr)
+}
+
+// Returns the queries sent from matching addresses, without duplicates.
+func (s *State) serviceQueriesFrom(match func(addr string) bool) []ServiceQuery {
+	var res []ServiceQuery
+	seen := make(map[string]struct{})
+	for _, query := range s.ServiceQueries {
+		if !match(query.SourceAddr) {
+			continue
+		}
+		if _, alreadySeen := seen[query.RawQuery]; alreadySeen {
+			continue
+		}
+
+		res = append(res, query)
+		seen[query.RawQuery] = struct{}{}
+	}
+	return res
+}
+
+func (s *State) ServiceInstancesForHost(host Host) []ServiceInstance {
+	var res []ServiceInstance
+	for _, instance := range s.ServiceInstances {
+		if instance.Host == host.Name {
+			res = append(res, instance)
+		}
+	}
+	return res
+}
@@ -0,0 +1,145 @@
+package discovery
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The attributes in a DNS-SD TXT record (RFC 6763 section 6), keyed by
+// lowercase key, since keys are case-insensitive.
+type TXTRecord map[string]TXTEntry
+
+type TXTEntry struct {
+	Key   string // as it appeared in the record
+	Value []byte // nil for boolean attributes, which have no "=" at all
+	Index int    // the position of the string in the record
+}
+
+// Parses the strings of a TXT record, as miekg/dns presents them: with
+// backslash escapes for quotes, backslashes, and unprintable bytes (\DDD).
+//
+// Following RFC 6763 section 6.4, empty strings and strings with no key are
+// ignored, and if a key appears more than once, only the first one counts.
+func ParseTXT(strs []string) TXTRecord {
+	res := make(TXTRecord)
+	for i, str := range strs {
+		raw := unescapeTXT(str)
+		if len(raw) == 0 || raw[0] == '=' {
+			continue
+		}
+
+		entry := TXTEntry{Key: string(raw), Index: i}
+		if eq := slices.Index(raw, '='); eq >= 0 {
+			entry.Key = string(raw[:eq])
+			entry.Value = raw[eq+1:]
+		}
+		key := strings.ToLower(entry.Key)
+		if _, ok := res[key]; !ok {
+			res[key] = entry
+		}
+	}
+	return res
+}
+
+// Undoes the escaping done by miekg/dns when unpacking a TXT string.
+func unescapeTXT(s string) []byte {
+	res := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			res = append(res, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			if n, err := strconv.Atoi(s[i+1 : i+4]); err == nil && n <= 255 {
+				res = append(res, byte(n))
+				i += 3
+				continue
+			}
+		}
+		res = append(res, s[i+1])
+		i++
+	}
+	return res
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+func (t TXTRecord) Has(key string) bool {
+	_, ok := t[strings.ToLower(key)]
+	return ok
+}
+
+// Returns the value of a key as a string. Boolean attributes have an empty
+// value.
+func (t TXTRecord) Get(key string) (string, bool) {
+	entry, ok := t[strings.ToLower(key)]
+	return string(entry.Value), ok
+}
+
+func (t TXTRecord) Bytes(key string) ([]byte, bool) {
+	entry, ok := t[strings.ToLower(key)]
+	return entry.Value, ok
+}
+
+// Returns the value of a key as a boolean. A key with no "=" is true, as are
+// values like "1" and "true"; values like "0" and "false" are false. Anything
+// else isn't a boolean.
+func (t TXTRecord) Bool(key string) (bool, bool) {
+	entry, ok := t[strings.ToLower(key)]
+	if !ok {
+		return false, false
+	}
+	if entry.Value == nil {
+		return true, true
+	}
+	res, err := strconv.ParseBool(string(entry.Value))
+	return res, err == nil
+}
+
+// Returns the value of a key as an integer, in decimal, or in hex with a 0x
+// prefix.
+func (t TXTRecord) Int(key string) (int64, bool) {
+	entry, ok := t[strings.ToLower(key)]
+	if !ok {
+		return 0, false
+	}
+	value := string(entry.Value)
+	base := 10
+	if hex, ok := strings.CutPrefix(strings.ToLower(value), "0x"); ok {
+		value, base = hex, 16
+	}
+	res, err := strconv.ParseInt(value, base, 64)
+	return res, err == nil
+}
+
+// The attributes in the order they appeared in the record.
+func (t TXTRecord) Entries() []TXTEntry {
+	res := make([]TXTEntry, 0, len(t))
+	for _, entry := range t {
+		res = append(res, entry)
+	}
+	slices.SortFunc(res, func(a, b TXTEntry) int { return a.Index - b.Index })
+	return res
+}
+
+// Formats an attribute for display, escaping any bytes that aren't printable.
+func (e TXTEntry) String() string {
+	if e.Value == nil {
+		return e.Key
+	}
+	var b strings.Builder
+	b.WriteString(e.Key)
+	b.WriteByte('=')
+	for _, c := range e.Value {
+		if c < ' ' || c > '~' {
+			fmt.Fprintf(&b, `\x%02x`, c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
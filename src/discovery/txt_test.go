@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTXT(t *testing.T) {
+	txt := ParseTXT([]string{
+		"deviceid=A6:D9:07:AA:AC:61",
+		"DeviceID=ignored",
+		"features=0x5A7FFFF7",
+		"vv=2",
+		"flags=",
+		"pw",
+		"acl=0",
+		"",
+		"=novalue",
+		`bin=\000\255\"\\`,
+	})
+
+	id, ok := txt.Get("deviceID")
+	assert.True(t, ok)
+	assert.Equal(t, "A6:D9:07:AA:AC:61", id)
+	assert.Equal(t, "deviceid", txt["deviceid"].Key)
+
+	features, ok := txt.Int("features")
+	assert.True(t, ok)
+	assert.Equal(t, int64(0x5A7FFFF7), features)
+	vv, _ := txt.Int("vv")
+	assert.Equal(t, int64(2), vv)
+
+	// An empty value is not the same as no value.
+	flags, ok := txt.Bytes("flags")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{}, flags)
+	_, ok = txt.Bool("flags")
+	assert.False(t, ok)
+
+	pw, ok := txt.Bool("pw")
+	assert.True(t, ok)
+	assert.True(t, pw)
+	acl, ok := txt.Bool("acl")
+	assert.True(t, ok)
+	assert.False(t, acl)
+	assert.False(t, txt.Has("missing"))
+
+	bin, _ := txt.Bytes("bin")
+	assert.Equal(t, []byte{0, 255, '"', '\\'}, bin)
+	assert.Equal(t, `bin=\x00\xff"\`, txt["bin"].String())
+
+	var keys []string
+	for _, entry := range txt.Entries() {
+		keys = append(keys, entry.Key)
+	}
+	assert.Equal(t, []string{"deviceid", "features", "vv", "flags", "pw", "acl", "bin"}, keys)
+}
+
+func TestParseTXTFromWire(t *testing.T) {
+	// The escaping miekg/dns does when unpacking must round-trip.
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: "x._airplay._tcp.local.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{"pk=\\001\\002\\003"},
+	}
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{rr}
+	packed, err := msg.Pack()
+	if !assert.Nil(t, err) {
+		return
+	}
+	var unpacked dns.Msg
+	if !assert.Nil(t, unpacked.Unpack(packed)) {
+		return
+	}
+
+	pk, _ := ParseTXT(unpacked.Answer[0].(*dns.TXT).Txt).Bytes("pk")
+	assert.Equal(t, []byte{1, 2, 3}, pk)
+}
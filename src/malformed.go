@@ -0,0 +1,158 @@
+package src
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AllenDang/cimgui-go/imgui"
+	"github.com/bvisness/buongiorno/src/packet"
+)
+
+// Malformed packets are kept around for inspection, up to a limit, so that a
+// misbehaving device can't eat all our memory.
+const maxMalformedPackets = 500
+
+// Likewise, at most this many payloads are saved automatically per session, so
+// that a misbehaving device can't fill up the disk.
+const maxAutoSavedMalformed = 100
+
+type malformedEntry struct {
+	packet.MalformedPacket
+	ID      int // stays the same as older entries are dropped
+	Source  string
+	SavedAs string // the fixture file the payload was saved to, if any
+}
+
+var (
+	malformedMu      sync.Mutex
+	malformedPackets []malformedEntry
+	nextMalformedID  int
+
+	// Where malformed payloads are saved, so they can be turned into regression
+	// fixtures (see src/packet/testdata/malformed).
+	MalformedDir = "malformed"
+	// If set, malformed payloads from live capture are saved as soon as they
+	// arrive, until maxAutoSavedMalformed of them have been. Set from the UI,
+	// but read by the collectors.
+	autoSaveMalformed  atomic.Bool
+	autoSavedMalformed int
+)
+
+func collectMalformedPackets(source *CaptureSource, malformed <-chan packet.MalformedPacket) {
+	for m := range malformed {
+		log.Printf("ERROR: malformed packet from %s: %v", m.SrcAddr, m.Err)
+
+		entry := malformedEntry{MalformedPacket: m, Source: source.Name}
+		if source.Live {
+			recordPacket(m.MDNSPacket)
+			if reserveAutoSave() {
+				saveMalformed(&entry)
+			}
+		}
+
+		malformedMu.Lock()
+		entry.ID = nextMalformedID
+		nextMalformedID++
+		malformedPackets = append(malformedPackets, entry)
+		if len(malformedPackets) > maxMalformedPackets {
+			malformedPackets = malformedPackets[len(malformedPackets)-maxMalformedPackets:]
+		}
+		malformedMu.Unlock()
+	}
+}
+
+// Checks whether the next malformed payload should be saved automatically, and
+// counts it against the limit if so.
+func reserveAutoSave() bool {
+	malformedMu.Lock()
+	defer malformedMu.Unlock()
+	if !autoSaveMalformed.Load() || autoSavedMalformed >= maxAutoSavedMalformed {
+		return false
+	}
+	autoSavedMalformed++
+	if autoSavedMalformed == maxAutoSavedMalformed {
+		log.Printf("WARNING: Saved %d malformed packets; not saving any more automatically", maxAutoSavedMalformed)
+	}
+	return true
+}
+
+func saveMalformed(entry *malformedEntry) {
+	filename, err := packet.SaveMalformed(MalformedDir, entry.MalformedPacket)
+	if err != nil {
+		log.Printf("ERROR: Failed to save malformed packet: %v", err)
+		return
+	}
+	entry.SavedAs = filename
+}
+
+// Records where an entry's payload was saved, if the entry is still around.
+func setMalformedSavedAs(id int, filename string) {
+	malformedMu.Lock()
+	defer malformedMu.Unlock()
+	for i := range malformedPackets {
+		if malformedPackets[i].ID == id {
+			malformedPackets[i].SavedAs = filename
+		}
+	}
+}
+
+func malformedUI() {
+	// Work from a copy, so that the collectors aren't held up while we draw
+	// or save to disk.
+	malformedMu.Lock()
+	entries := slices.Clone(malformedPackets)
+	autoSaved := autoSavedMalformed
+	malformedMu.Unlock()
+
+	title := fmt.Sprintf("Malformed packets (%d)###Malformed packets", len(entries))
+	if imgui.Begin(title) {
+		autoSave := autoSaveMalformed.Load()
+		if imgui.Checkbox(fmt.Sprintf("Save live payloads to %s/ (%d/%d)###Auto-save", MalformedDir, autoSaved, maxAutoSavedMalformed), &autoSave) {
+			autoSaveMalformed.Store(autoSave)
+		}
+		imgui.SetItemTooltip(fmt.Sprintf("Saves each malformed payload from live capture as it arrives, up to %d per session.", maxAutoSavedMalformed))
+		imgui.SameLine()
+		if imgui.Button("Clear") {
+			malformedMu.Lock()
+			malformedPackets = nil
+			malformedMu.Unlock()
+		}
+
+		// Newest first
+		for i := len(entries) - 1; i >= 0; i-- {
+			entry := &entries[i]
+			label := fmt.Sprintf("%s %s:%d: %v###malformed%d",
+				entry.Timestamp.Format("15:04:05.000"), entry.SrcAddr, entry.SrcPort, entry.Err, entry.ID,
+			)
+			if imgui.TreeNodeExStr(label) {
+				imgui.Text(fmt.Sprintf("Error: %v", entry.Err))
+				imgui.Text(fmt.Sprintf("Source: %s", entry.Source))
+				imgui.Text(fmt.Sprintf("Interface: %s", entry.Interface))
+				imgui.Text(fmt.Sprintf("From: %s:%d", entry.SrcAddr, entry.SrcPort))
+				imgui.Text(fmt.Sprintf("To: %s:%d (%s)", entry.DstAddr, entry.DstPort, entry.Addressing()))
+				if entry.SavedAs != "" {
+					imgui.Text(fmt.Sprintf("Saved as: %s", entry.SavedAs))
+				} else if imgui.Button("Save as fixture") {
+					saveMalformed(entry)
+					setMalformedSavedAs(entry.ID, entry.SavedAs)
+				}
+
+				if imgui.TreeNodeExStrStr("hex", 0, fmt.Sprintf("Hex dump (%d bytes)", len(entry.Payload))) {
+					imgui.TextUnformatted(hex.Dump(entry.Payload))
+					imgui.TreePop()
+				}
+				if imgui.TreeNodeExStrStr("partial", 0, "Partial decode") {
+					imgui.TextUnformatted(entry.DNS.String())
+					imgui.TreePop()
+				}
+
+				imgui.TreePop()
+			}
+		}
+	}
+	imgui.End()
+}
@@ -0,0 +1,285 @@
+package packet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	mdnsGroupIPv4 = net.IPv4(224, 0, 0, 251)
+	mdnsGroupIPv6 = net.ParseIP("ff02::fb")
+)
+
+const mdnsPort = 5353
+
+// A SocketCapture receives mDNS packets by joining the mDNS multicast groups on
+// an ordinary UDP socket. Unlike a packet capture, this needs neither libpcap
+// nor special privileges. However, it only sees packets that the OS would
+// deliver to an mDNS responder anyway, and the packets have no link-layer data.
+type SocketCapture struct {
+	sourceChans
+	conn4 *ipv4.PacketConn
+	conn6 *ipv6.PacketConn
+	mode  CaptureMode
+
+	// Control messages only give us an interface index, so we cache the
+	// lookup of its name.
+	intfNamesMu sync.Mutex
+	intfNames   map[int]string
+}
+
+// Starts listening for mDNS packets on the given interfaces. If no interfaces
+// are given, the multicast groups are joined on every interface that supports
+// multicast. Both IPv4 and IPv6 are attempted; it is only an error if neither
+// works.
+//
+// Since we can't use BPF here, packets outside the capture mode are dropped
+// after they have been received.
+func ListenMDNS(interfaces []string, mode CaptureMode) (*SocketCapture, error) {
+	intfs, err := MulticastInterfaces(interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &SocketCapture{
+		sourceChans: newSourceChans(),
+		mode:        mode,
+		intfNames:   make(map[int]string),
+	}
+
+	// Other mDNS responders on this machine (e.g. Avahi or mDNSResponder) will
+	// already be bound to port 5353, so we have to share it.
+	lc := net.ListenConfig{Control: reusePort}
+
+	var err4, err6 error
+	if conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", mdnsPort)); err == nil {
+		c.conn4 = ipv4.NewPacketConn(conn)
+		err4 = c.conn4.SetControlMessage(ipv4.FlagTTL|ipv4.FlagSrc|ipv4.FlagDst|ipv4.FlagInterface, true)
+		if err4 == nil {
+			err4 = joinGroup(intfs, func(intf *net.Interface) error {
+				return c.conn4.JoinGroup(intf, &net.UDPAddr{IP: mdnsGroupIPv4})
+			})
+		}
+	} else {
+		err4 = err
+	}
+	if conn, err := lc.ListenPacket(context.Background(), "udp6", fmt.Sprintf("[::]:%d", mdnsPort)); err == nil {
+		c.conn6 = ipv6.NewPacketConn(conn)
+		err6 = c.conn6.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagDst|ipv6.FlagInterface, true)
+		if err6 == nil {
+			err6 = joinGroup(intfs, func(intf *net.Interface) error {
+				return c.conn6.JoinGroup(intf, &net.UDPAddr{IP: mdnsGroupIPv6})
+			})
+		}
+	} else {
+		err6 = err
+	}
+
+	if err4 != nil && err6 != nil {
+		c.Close()
+		return nil, fmt.Errorf("could not listen for mDNS: %w", errors.Join(err4, err6))
+	}
+
+	c.expireLive()
+	var wg sync.WaitGroup
+	if err4 == nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.read4()
+		}()
+	} else {
+		log.Printf("WARNING: Could not listen for mDNS over IPv4: %v", err4)
+	}
+	if err6 == nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.read6()
+		}()
+	} else {
+		log.Printf("WARNING: Could not listen for mDNS over IPv6: %v", err6)
+	}
+	go func() {
+		wg.Wait()
+		c.close()
+	}()
+
+	return c, nil
+}
+
+// Looks up the named interfaces, or if there are none, returns every interface
+// that is up and does multicast.
+func MulticastInterfaces(names []string) ([]net.Interface, error) {
+	if len(names) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		var res []net.Interface
+		for _, intf := range all {
+			if intf.Flags&net.FlagUp != 0 && intf.Flags&net.FlagMulticast != 0 {
+				res = append(res, intf)
+			}
+		}
+		return res, nil
+	}
+
+	var res []net.Interface
+	for _, name := range names {
+		intf, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("no interface found named %s: %w", name, err)
+		}
+		res = append(res, *intf)
+	}
+	return res, nil
+}
+
+// Joins a multicast group on every interface, succeeding if at least one
+// interface could join.
+func joinGroup(intfs []net.Interface, join func(intf *net.Interface) error) error {
+	var errs []error
+	for i := range intfs {
+		if err := join(&intfs[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", intfs[i].Name, err))
+		}
+	}
+	if len(errs) == len(intfs) {
+		return fmt.Errorf("could not join multicast group on any interface: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// The parts of a received datagram that we care about, from either IPv4 or
+// IPv6.
+type datagram struct {
+	n            int
+	src          net.Addr
+	srcIP, dstIP net.IP // from control messages; srcIP is IPv4 only
+	ifIndex      int
+	ttl          int
+}
+
+func (c *SocketCapture) read4() {
+	c.readLoop(func(buf []byte) (datagram, error) {
+		n, cm, src, err := c.conn4.ReadFrom(buf)
+		d := datagram{n: n, src: src}
+		if cm != nil {
+			d.srcIP, d.dstIP, d.ifIndex, d.ttl = cm.Src, cm.Dst, cm.IfIndex, cm.TTL
+		}
+		return d, err
+	})
+}
+
+func (c *SocketCapture) read6() {
+	c.readLoop(func(buf []byte) (datagram, error) {
+		n, cm, src, err := c.conn6.ReadFrom(buf)
+		d := datagram{n: n, src: src}
+		if cm != nil {
+			d.dstIP, d.ifIndex, d.ttl = cm.Dst, cm.IfIndex, cm.HopLimit
+		}
+		return d, err
+	})
+}
+
+func (c *SocketCapture) readLoop(read func(buf []byte) (datagram, error)) {
+	buf := make([]byte, 9000)
+	for {
+		d, err := read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("ERROR: Failed to read mDNS packet: %v", err)
+			}
+			return
+		}
+
+		res := MDNSPacket{
+			Timestamp: time.Now(),
+			Interface: c.interfaceName(d.ifIndex),
+			DstPort:   mdnsPort,
+			TTL:       d.ttl,
+			Length:    d.n,
+		}
+		if udpAddr, ok := d.src.(*net.UDPAddr); ok {
+			res.SrcAddr = udpAddr.IP.String()
+			res.SrcPort = udpAddr.Port
+		}
+		if d.srcIP != nil {
+			res.SrcAddr = d.srcIP.String()
+		}
+		if d.dstIP != nil {
+			res.DstAddr = d.dstIP.String()
+			res.Multicast = d.dstIP.IsMulticast()
+		}
+		if !c.mode.Allows(res) {
+			continue
+		}
+
+		payload := make([]byte, d.n)
+		copy(payload, buf)
+		c.emit(res, payload)
+	}
+}
+
+func (c *SocketCapture) interfaceName(index int) string {
+	if index == 0 {
+		return ""
+	}
+
+	c.intfNamesMu.Lock()
+	defer c.intfNamesMu.Unlock()
+	if name, ok := c.intfNames[index]; ok {
+		return name
+	}
+	name := ""
+	if intf, err := net.InterfaceByIndex(index); err == nil {
+		name = intf.Name
+	}
+	c.intfNames[index] = name
+	return name
+}
+
+func (c *SocketCapture) Close() {
+	if c.conn4 != nil {
+		c.conn4.Close()
+	}
+	if c.conn6 != nil {
+		c.conn6.Close()
+	}
+}
+
+// Lists the network interfaces on this machine. See also libpcap.ListInterfaces,
+// which includes the devices only libpcap knows about.
+func ListInterfaces() ([]Interface, error) {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Interface
+	for _, intf := range intfs {
+		res = append(res, interfaceFromNet(intf))
+	}
+	return res, nil
+}
+
+func interfaceFromNet(intf net.Interface) Interface {
+	res := Interface{Name: intf.Name}
+	if addrs, err := intf.Addrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				res.Addrs = append(res.Addrs, ipnet.IP)
+			}
+		}
+	}
+	return res
+}
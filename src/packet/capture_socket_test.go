@@ -0,0 +1,52 @@
+package packet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenMDNS(t *testing.T) {
+	// We send from an ephemeral port, which makes this a legacy unicast query.
+	c, err := ListenMDNS(nil, CaptureLegacyUnicast)
+	if err != nil {
+		t.Skipf("Could not listen for mDNS in this environment: %v", err)
+	}
+	defer c.Close()
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: mdnsGroupIPv4, Port: mdnsPort})
+	if err != nil {
+		t.Skipf("Could not send multicast in this environment: %v", err)
+	}
+	defer conn.Close()
+
+	var query dns.Msg
+	query.SetQuestion("_buongiorno-test._tcp.local.", dns.TypePTR)
+	payload, err := query.Pack()
+	if !assert.Nil(t, err) {
+		return
+	}
+	if _, err := conn.Write(payload); err != nil {
+		t.Skipf("Could not send multicast in this environment: %v", err)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case p := <-c.Packets():
+			if len(p.DNS.Question) == 0 || p.DNS.Question[0].Name != "_buongiorno-test._tcp.local." {
+				continue // someone else's traffic
+			}
+			assert.Equal(t, "224.0.0.251", p.DstAddr)
+			assert.True(t, p.Multicast)
+			assert.NotEmpty(t, p.SrcAddr)
+			assert.NotZero(t, p.SrcPort)
+			return
+		case <-timeout:
+			t.Skip("Multicast loopback does not seem to work in this environment")
+		}
+	}
+}
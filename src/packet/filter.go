@@ -0,0 +1,113 @@
+package packet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Which mDNS traffic a live capture picks up. Each mode includes everything the
+// previous one does.
+type CaptureMode int
+
+const (
+	// Only packets sent from port 5353 to the mDNS multicast groups.
+	CaptureMulticast CaptureMode = iota
+	// Also unicast packets between port 5353s, e.g. the replies to questions
+	// with the QU bit set (RFC 6762 section 5.4).
+	CaptureUnicastResponses
+	// Also "legacy unicast" queries, sent from ports other than 5353 by simple
+	// resolvers, and the replies to them (RFC 6762 section 6.7).
+	CaptureLegacyUnicast
+)
+
+var CaptureModes = []CaptureMode{CaptureMulticast, CaptureUnicastResponses, CaptureLegacyUnicast}
+
+func (m CaptureMode) String() string {
+	switch m {
+	case CaptureMulticast:
+		return "multicast"
+	case CaptureUnicastResponses:
+		return "unicast"
+	case CaptureLegacyUnicast:
+		return "legacy"
+	default:
+		return fmt.Sprintf("CaptureMode(%d)", int(m))
+	}
+}
+
+// A longer description for the UI.
+func (m CaptureMode) Description() string {
+	switch m {
+	case CaptureMulticast:
+		return "Multicast only"
+	case CaptureUnicastResponses:
+		return "Multicast + unicast responses"
+	case CaptureLegacyUnicast:
+		return "Multicast + unicast + legacy unicast"
+	default:
+		return m.String()
+	}
+}
+
+func ParseCaptureMode(s string) (CaptureMode, error) {
+	for _, m := range CaptureModes {
+		if strings.EqualFold(s, m.String()) {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown capture mode %q (expected multicast, unicast, or legacy)", s)
+}
+
+// The BPF expression that captures this mode's traffic.
+func (m CaptureMode) BPF() string {
+	switch m {
+	case CaptureMulticast:
+		return "udp src port 5353 and udp dst port 5353 and (dst host 224.0.0.251 or dst host ff02::fb)"
+	case CaptureUnicastResponses:
+		return "udp src port 5353 and udp dst port 5353"
+	default:
+		return "udp port 5353"
+	}
+}
+
+// Checks whether a packet belongs to this mode's traffic, for when we can't use
+// a BPF filter (e.g. with ListenMDNS).
+func (m CaptureMode) Allows(p MDNSPacket) bool {
+	switch m {
+	case CaptureMulticast:
+		return p.SrcPort == mdnsPort && p.DstPort == mdnsPort && p.Multicast
+	case CaptureUnicastResponses:
+		return p.SrcPort == mdnsPort && p.DstPort == mdnsPort
+	default:
+		return p.SrcPort == mdnsPort || p.DstPort == mdnsPort
+	}
+}
+
+// Decides which packets a live capture keeps.
+type CaptureFilter struct {
+	Mode CaptureMode
+	// A BPF expression to use instead of the one for Mode, for advanced users.
+	// Packets it lets through are not filtered any further.
+	Custom string
+}
+
+// The BPF expression to give to libpcap.
+func (f CaptureFilter) Expression() string {
+	if f.Custom != "" {
+		return f.Custom
+	}
+	// Only the first fragment of a fragmented datagram has a UDP header,
+	// so we also have to let through all non-first IPv4 fragments.
+	return fmt.Sprintf("(%s) or (ip and ip[6:2] & 0x1fff != 0)", f.Mode.BPF())
+}
+
+func (f CaptureFilter) Allows(p MDNSPacket) bool {
+	return f.Custom != "" || f.Mode.Allows(p)
+}
+
+func (f CaptureFilter) String() string {
+	if f.Custom != "" {
+		return fmt.Sprintf("BPF %q", f.Custom)
+	}
+	return f.Mode.String()
+}
@@ -0,0 +1,38 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureModeAllows(t *testing.T) {
+	multicast := MDNSPacket{SrcPort: 5353, DstPort: 5353, Multicast: true}
+	unicastResponse := MDNSPacket{SrcPort: 5353, DstPort: 5353}
+	legacyQuery := MDNSPacket{SrcPort: 49152, DstPort: 5353, Multicast: true}
+	legacyResponse := MDNSPacket{SrcPort: 5353, DstPort: 49152}
+
+	cases := []struct {
+		mode    CaptureMode
+		allowed []bool
+	}{
+		{CaptureMulticast, []bool{true, false, false, false}},
+		{CaptureUnicastResponses, []bool{true, true, false, false}},
+		{CaptureLegacyUnicast, []bool{true, true, true, true}},
+	}
+	for _, c := range cases {
+		t.Run(c.mode.String(), func(t *testing.T) {
+			for i, p := range []MDNSPacket{multicast, unicastResponse, legacyQuery, legacyResponse} {
+				assert.Equal(t, c.allowed[i], c.mode.Allows(p), "packet %d", i)
+			}
+
+			parsed, err := ParseCaptureMode(c.mode.String())
+			assert.Nil(t, err)
+			assert.Equal(t, c.mode, parsed)
+		})
+	}
+
+	custom := CaptureFilter{Mode: CaptureMulticast, Custom: "udp"}
+	assert.True(t, custom.Allows(legacyResponse))
+	assert.Equal(t, "udp", custom.Expression())
+}
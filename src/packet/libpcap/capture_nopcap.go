@@ -0,0 +1,33 @@
+//go:build !cgo || nopcap
+
+package libpcap
+
+import (
+	"fmt"
+
+	"github.com/bvisness/buongiorno/src/packet"
+)
+
+// Packet capture needs libpcap, which needs cgo. Without it, only ListenMDNS
+// is available.
+var errNoPcap = fmt.Errorf("%w: this build of Buongiorno does not include libpcap; try the multicast socket instead", ErrNoPcap)
+
+// Lists the network interfaces on this machine.
+func ListInterfaces() ([]packet.Interface, error) {
+	return packet.ListInterfaces()
+}
+
+type Capture struct {
+	*packet.LinkSource
+}
+
+func CaptureMDNS(interfaces []string, filter packet.CaptureFilter) (*Capture, error) {
+	return nil, errNoPcap
+}
+
+func (c *Capture) Close() {}
+
+// Without libpcap there are no BPF filters to check.
+func ValidateFilter(f packet.CaptureFilter) error {
+	return nil
+}
@@ -0,0 +1,125 @@
+//go:build cgo && !nopcap
+
+package libpcap
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Lists the interfaces that libpcap is able to capture on.
+func ListInterfaces() ([]packet.Interface, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []packet.Interface
+	for _, dev := range devs {
+		intf := packet.Interface{
+			Name:        dev.Name,
+			Description: dev.Description,
+		}
+		for _, addr := range dev.Addresses {
+			intf.Addrs = append(intf.Addrs, addr.IP)
+		}
+		res = append(res, intf)
+	}
+	return res, nil
+}
+
+// A live packet capture on one or more interfaces, using libpcap.
+type Capture struct {
+	*packet.LinkSource
+	handles []*pcap.Handle
+}
+
+// Starts capturing mDNS packets on the given interfaces. If no interfaces are
+// given, captures on every interface that is up and does multicast, with one
+// handle each so that we know which interface every packet arrived on. (The
+// "any" device on Linux would capture them all at once, but without saying
+// where each packet came from.) Interfaces that can't be opened are skipped in
+// that case, as long as at least one can be.
+func CaptureMDNS(interfaces []string, filter packet.CaptureFilter) (*Capture, error) {
+	all := len(interfaces) == 0
+	if all {
+		intfs, err := packet.MulticastInterfaces(nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not list interfaces: %w", err)
+		}
+		for _, intf := range intfs {
+			interfaces = append(interfaces, intf.Name)
+		}
+	}
+
+	c := &Capture{}
+	var opened []string
+	var errs []error
+	for _, intf := range interfaces {
+		handle, err := pcap.OpenLive(intf, 1600, true, pcap.BlockForever)
+		if err != nil {
+			err = fmt.Errorf("%w: could not capture on %s: %w", ErrNoPcap, intf, err)
+			if all {
+				errs = append(errs, err)
+				continue
+			}
+			c.Close()
+			return nil, err
+		}
+		c.handles = append(c.handles, handle)
+		opened = append(opened, intf)
+
+		err = handle.SetBPFFilter(filter.Expression())
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("invalid capture filter %s: %w", filter, err)
+		}
+	}
+	if len(c.handles) == 0 {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("no interfaces to capture on")
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	c.LinkSource = packet.NewLinkSource()
+	var wg sync.WaitGroup
+	for i, handle := range c.handles {
+		feed := c.Feeder(opened[i], filter)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+			for p := range packetSource.Packets() {
+				feed(p, handle.LinkType())
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		c.Finish()
+	}()
+
+	return c, nil
+}
+
+// Checks that the filter's BPF expression compiles, so that a typo in a custom
+// filter can be reported before we try to start a capture with it.
+func ValidateFilter(f packet.CaptureFilter) error {
+	if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 1600, f.Expression()); err != nil {
+		return fmt.Errorf("invalid capture filter %s: %w", f, err)
+	}
+	return nil
+}
+
+func (c *Capture) Close() {
+	for _, handle := range c.handles {
+		handle.Close()
+	}
+}
@@ -0,0 +1,14 @@
+// Package libpcap captures mDNS packets with libpcap. It is kept apart from
+// package packet because it needs cgo and the libpcap headers, which programs
+// that only read capture files or use the multicast socket can do without.
+//
+// Builds without cgo, or with the nopcap tag, get stubs that return ErrNoPcap.
+package libpcap
+
+import "errors"
+
+// Returned by CaptureMDNS, possibly wrapped, when libpcap can't be used at all:
+// either this build doesn't include it, or it can't open a capture handle (for
+// example, because we don't have permission). The multicast socket may still
+// work in that case.
+var ErrNoPcap = errors.New("packet capture is unavailable")
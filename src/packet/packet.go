@@ -1,12 +1,24 @@
 package packet
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/bvisness/buongiorno/src/utils"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/miekg/dns"
 )
 
@@ -18,101 +30,539 @@ func ParsePacket(packet []byte) (dns.Msg, error) {
 	return msg, nil
 }
 
+// Like ParsePacket, but on failure returns whatever could be decoded before the
+// error (usually the header and some of the records).
+func ParsePartialPacket(packet []byte) (dns.Msg, error) {
+	var msg dns.Msg
+	err := msg.Unpack(packet)
+	if err == nil || len(packet) < 12 {
+		return msg, err
+	}
+
+	// Unpack throws away an entire section if any record in it is bad, so we
+	// go record by record to salvage as much as we can.
+	var counts [4]int
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(packet[4+2*i:]))
+	}
+	off := 12
+
+	msg.Question = nil
+	for i := 0; i < counts[0]; i++ {
+		name, off1, qerr := dns.UnpackDomainName(packet, off)
+		if qerr != nil || off1+4 > len(packet) {
+			return msg, err
+		}
+		msg.Question = append(msg.Question, dns.Question{
+			Name:   name,
+			Qtype:  binary.BigEndian.Uint16(packet[off1:]),
+			Qclass: binary.BigEndian.Uint16(packet[off1+2:]),
+		})
+		off = off1 + 4
+	}
+
+	msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+	for i, section := range []*[]dns.RR{&msg.Answer, &msg.Ns, &msg.Extra} {
+		for j := 0; j < counts[i+1]; j++ {
+			rr, off1, rrerr := dns.UnpackRR(packet, off)
+			if rrerr != nil {
+				return msg, err
+			}
+			*section = append(*section, rr)
+			off = off1
+		}
+	}
+	return msg, err
+}
+
 type MDNSPacket struct {
+	Timestamp        time.Time // when the packet was captured
+	Interface        string    // the interface the packet arrived on, if known
 	SrcAddr, DstAddr string
 	SrcPort, DstPort int
+	Multicast        bool // sent to a multicast group, as opposed to unicast
 	DNS              dns.Msg
+
+	SrcMAC net.HardwareAddr // nil if the link layer has no MAC addresses
+	VLAN   int              // 802.1Q VLAN ID, or 0 if untagged
+	TTL    int              // IPv4 TTL or IPv6 hop limit, or 0 if unknown
+	Length int              // length of the packet on the wire (just the UDP payload for ListenMDNS)
+
+	// The original link-layer frame, so that the packet can be written back out
+	// to a capture file.
+	LinkType layers.LinkType
+	RawData  []byte
+
+	// If this was a fragmented IPv4 datagram, the frames of its fragments, in
+	// the order they arrived. RawData is nil in that case.
+	Fragments []MDNSPacket
+
+	// If this was a truncated query, the packets carrying the rest of its
+	// known answers. Their records have already been merged into DNS.
+	Continuations []MDNSPacket
+}
+
+// "multicast" or "unicast", for display.
+func (p MDNSPacket) Addressing() string {
+	if p.Multicast {
+		return "multicast"
+	}
+	return "unicast"
+}
+
+// Returns a copy of the packet with its timestamp, and those of its fragments
+// and continuations, moved by d. Used to replay a capture as if it had been
+// captured at another time.
+func (p MDNSPacket) Shifted(d time.Duration) MDNSPacket {
+	p.Timestamp = p.Timestamp.Add(d)
+	p.Fragments = shiftAll(p.Fragments, d)
+	p.Continuations = shiftAll(p.Continuations, d)
+	return p
+}
+
+func shiftAll(packets []MDNSPacket, d time.Duration) []MDNSPacket {
+	if packets == nil {
+		return nil
+	}
+	res := make([]MDNSPacket, len(packets))
+	for i, p := range packets {
+		res[i] = p.Shifted(d)
+	}
+	return res
+}
+
+// A packet that was sent to or from the mDNS port but could not be parsed as a
+// DNS message. DNS contains whatever could be decoded before the error.
+type MalformedPacket struct {
+	MDNSPacket
+	Payload []byte // the raw UDP payload
+	Err     error
+}
+
+// A network interface that packets can be captured on.
+type Interface struct {
+	Name        string
+	Description string
+	Addrs       []net.IP
+}
+
+// A Source produces a stream of mDNS packets. Implemented by the libpcap
+// capture (libpcap.CaptureMDNS), the multicast socket (ListenMDNS), and capture
+// files (ReadMDNSFile).
+//
+// Both channels must be drained, or the source will stall.
+type Source interface {
+	// The captured packets. The channel is closed once the source is closed
+	// or runs out of packets.
+	Packets() <-chan MDNSPacket
+	// Packets that failed to parse. Closed at the same time as Packets.
+	Malformed() <-chan MalformedPacket
+	Close()
 }
 
-func CaptureMDNS() (<-chan MDNSPacket, error) {
-	out := make(chan MDNSPacket, 1000)
-	handle, err := pcap.OpenLive("any", 1600, true, pcap.BlockForever)
+// The output channels of a Source, shared by all implementations. Truncated
+// queries are held back until the rest of their known answers arrive.
+type sourceChans struct {
+	out       chan MDNSPacket
+	malformed chan MalformedPacket
+
+	tcMu sync.Mutex
+	tc   tcReassembler
+
+	// Live sources can't rely on further packets arriving to expire truncated
+	// queries, so they check on a timer instead.
+	stopExpiring chan struct{}
+	expiring     sync.WaitGroup
+}
+
+func newSourceChans() sourceChans {
+	return sourceChans{
+		out:          make(chan MDNSPacket, 1000),
+		malformed:    make(chan MalformedPacket, 1000),
+		stopExpiring: make(chan struct{}),
+	}
+}
+
+// Starts expiring truncated queries using the wall clock. Only for live
+// sources, whose packet timestamps are the time of capture.
+func (c *sourceChans) expireLive() {
+	c.expiring.Add(1)
+	go func() {
+		defer c.expiring.Done()
+		ticker := time.NewTicker(tcWait / 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stopExpiring:
+				return
+			case now := <-ticker.C:
+				c.tcMu.Lock()
+				ready := c.tc.expire(now)
+				c.tcMu.Unlock()
+				c.send(ready)
+			}
+		}
+	}()
+}
+
+func (c *sourceChans) Packets() <-chan MDNSPacket {
+	return c.out
+}
+
+func (c *sourceChans) Malformed() <-chan MalformedPacket {
+	return c.malformed
+}
+
+// Parses a UDP payload and sends the result on the appropriate channel.
+func (c *sourceChans) emit(res MDNSPacket, payload []byte) {
+	msg, err := ParsePartialPacket(payload)
+	res.DNS = msg
 	if err != nil {
-		return nil, err
+		c.malformed <- MalformedPacket{
+			MDNSPacket: res,
+			Payload:    payload,
+			Err:        err,
+		}
+		return
+	}
+
+	c.tcMu.Lock()
+	ready := c.tc.expire(res.Timestamp)
+	ready = append(ready, c.tc.add(res)...)
+	c.tcMu.Unlock()
+	c.send(ready)
+}
+
+func (c *sourceChans) send(packets []MDNSPacket) {
+	for _, p := range packets {
+		c.out <- p
 	}
+}
+
+// Must only be called once nothing else will call emit.
+func (c *sourceChans) close() {
+	close(c.stopExpiring)
+	c.expiring.Wait()
+
+	c.tcMu.Lock()
+	ready := c.tc.flush()
+	c.tcMu.Unlock()
+	c.send(ready)
+
+	close(c.out)
+	close(c.malformed)
+}
+
+// A live Source fed with link-layer frames captured outside this package, e.g.
+// by package libpcap.
+type LinkSource struct {
+	sourceChans
+}
+
+func NewLinkSource() *LinkSource {
+	s := &LinkSource{sourceChans: newSourceChans()}
+	s.expireLive()
+	return s
+}
 
-	// for only multicast: udp port 5353 and (dst host 224.0.0.251 or dst host ff02::fb)
-	err = handle.SetBPFFilter("udp port 5353")
+// Returns a function that decodes the frames captured on an interface and
+// emits the mDNS packets among them. Fragments are reassembled per feeder, so
+// each capture loop needs its own, and must not call it concurrently.
+func (s *LinkSource) Feeder(intf string, filter CaptureFilter) func(gopacket.Packet, layers.LinkType) {
+	frames := newFrameDecoder()
+	return func(packet gopacket.Packet, linkType layers.LinkType) {
+		// Reassembled fragments got past the BPF filter without their UDP
+		// header being checked.
+		if res, payload, ok := frames.decode(packet, linkType); ok && filter.Allows(res) {
+			res.Interface = intf
+			s.emit(res, payload)
+		}
+	}
+}
+
+// Closes the channels. Must only be called once no feeder will be called again.
+func (s *LinkSource) Finish() {
+	s.close()
+}
+
+// Reads mDNS packets from a .pcap or .pcapng file, e.g. one recorded by
+// Wireshark or tcpdump. The channels are closed once the whole file has been
+// read.
+func ReadMDNSFile(filename string) (*FileReader, error) {
+	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 
+	source, interfaceOf, err := openCaptureFile(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not read %s: %w", filename, err)
+	}
+
+	frames := newFrameDecoder()
+	r := &FileReader{
+		sourceChans: newSourceChans(),
+		done:        make(chan struct{}),
+	}
 	go func() {
-		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-		for packet := range packetSource.Packets() {
-			var res MDNSPacket
-
-			if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
-				ip, _ := ipv4Layer.(*layers.IPv4)
-				res.SrcAddr = ip.SrcIP.String()
-				res.DstAddr = ip.DstIP.String()
-			} else if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
-				ip, _ := ipv6Layer.(*layers.IPv6)
-				res.SrcAddr = ip.SrcIP.String()
-				res.DstAddr = ip.DstIP.String()
-			} else {
-				continue
+		defer f.Close()
+		defer r.close()
+
+		for {
+			select {
+			case <-r.done:
+				return
+			default:
 			}
 
-			if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
-				udp, _ := udpLayer.(*layers.UDP)
-				res.SrcPort = int(udp.SrcPort)
-				res.DstPort = int(udp.DstPort)
-
-				if msg, err := ParsePacket(udp.Payload); err == nil {
-					res.DNS = msg
-				} else {
-					fmt.Printf("ERROR: malformed packet: %v\n", err)
-					continue
-				}
-			} else {
-				continue
+			data, ci, err := source.ReadPacketData()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				log.Printf("ERROR: failed to read packet from %s: %v", filename, err)
+				return
 			}
 
-			out <- res
+			intf := interfaceOf(ci)
+			packet := gopacket.NewPacket(data, intf.LinkType, gopacket.Default)
+			packet.Metadata().CaptureInfo = ci
+			if res, payload, ok := frames.decode(packet, intf.LinkType); ok {
+				res.Interface = intf.Name
+				r.emit(res, payload)
+			}
 		}
 	}()
 
-	return out, nil
+	return r, nil
 }
 
-func SplitHost(host string) []string {
-	return strings.Split(strings.TrimRight(host, "."), ".")
+// Reads packets from a capture file. See ReadMDNSFile.
+type FileReader struct {
+	sourceChans
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
-func HostMatches(a, b string) bool {
-	aParts := SplitHost(a)
-	bParts := SplitHost(b)
+// Stops reading the file early.
+func (r *FileReader) Close() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
+}
 
-	// Early out to catch things like a.b.c.d ~= **.a.b.c.d
-	if len(aParts) < len(bParts) {
-		return false
+// Opens either a pcap or pcapng stream, depending on the magic number at the
+// start. Since pcapng files can contain several interfaces with different link
+// types, the interface must be looked up per packet.
+func openCaptureFile(r *bufio.Reader) (gopacket.PacketDataSource, func(gopacket.CaptureInfo) pcapgo.NgInterface, error) {
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if strings.HasPrefix(b, "**") {
-		numWildcards := len(aParts) - (len(bParts) - 1)
-		rest := bParts[1:]
-		bParts = []string{}
-		for i := 0; i < numWildcards; i++ {
-			bParts = append(bParts, "*")
+	if bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		ng, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, nil, err
 		}
-		bParts = append(bParts, rest...)
+		return ng, func(ci gopacket.CaptureInfo) pcapgo.NgInterface {
+			if intf, err := ng.Interface(ci.InterfaceIndex); err == nil {
+				return intf
+			}
+			return pcapgo.NgInterface{LinkType: ng.LinkType()}
+		}, nil
+	}
+
+	pr, err := pcapgo.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pr, func(gopacket.CaptureInfo) pcapgo.NgInterface {
+		return pcapgo.NgInterface{LinkType: pr.LinkType()}
+	}, nil
+}
+
+// Extracts the addressing info and UDP payload from a captured packet. Returns
+// false if the packet is not UDP over IP.
+func decodeUDP(packet gopacket.Packet, linkType layers.LinkType) (MDNSPacket, []byte, bool) {
+	res := MDNSPacket{
+		Timestamp: packet.Metadata().Timestamp,
+		Length:    utils.OrDefault(packet.Metadata().Length, len(packet.Data())),
+		LinkType:  linkType,
+		RawData:   packet.Data(),
+	}
+	decodeLink(packet, &res)
+
+	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
+		ip, _ := ipv4Layer.(*layers.IPv4)
+		res.SrcAddr = ip.SrcIP.String()
+		res.DstAddr = ip.DstIP.String()
+		res.Multicast = ip.DstIP.IsMulticast()
+		res.TTL = int(ip.TTL)
+	} else if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
+		ip, _ := ipv6Layer.(*layers.IPv6)
+		res.SrcAddr = ip.SrcIP.String()
+		res.DstAddr = ip.DstIP.String()
+		res.Multicast = ip.DstIP.IsMulticast()
+		res.TTL = int(ip.HopLimit)
+	} else {
+		return MDNSPacket{}, nil, false
 	}
-	if strings.HasSuffix(b, "**") {
-		numWildcards := len(aParts) - (len(bParts) - 1)
-		bParts = bParts[:len(bParts)-1]
-		for i := 0; i < numWildcards; i++ {
-			bParts = append(bParts, "*")
+
+	if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+		udp, _ := udpLayer.(*layers.UDP)
+		res.SrcPort = int(udp.SrcPort)
+		res.DstPort = int(udp.DstPort)
+		return res, udp.Payload, true
+	} else {
+		return MDNSPacket{}, nil, false
+	}
+}
+
+// Fills in the link-layer info (source MAC and VLAN) from a captured packet.
+func decodeLink(packet gopacket.Packet, res *MDNSPacket) {
+	if ethLayer := packet.Layer(layers.LayerTypeEthernet); ethLayer != nil {
+		eth, _ := ethLayer.(*layers.Ethernet)
+		res.SrcMAC = eth.SrcMAC
+	} else if sllLayer := packet.Layer(layers.LayerTypeLinuxSLL); sllLayer != nil {
+		// The "any" device on Linux gives us cooked headers instead of Ethernet.
+		sll, _ := sllLayer.(*layers.LinuxSLL)
+		if sll.AddrType == 1 && len(sll.Addr) == 6 { // ARPHRD_ETHER
+			res.SrcMAC = sll.Addr
 		}
 	}
+	if dot1qLayer := packet.Layer(layers.LayerTypeDot1Q); dot1qLayer != nil {
+		dot1q, _ := dot1qLayer.(*layers.Dot1Q)
+		res.VLAN = int(dot1q.VLANIdentifier)
+	}
+}
+
+// Writes the payload of a malformed packet to a file in the given directory,
+// so that it can be turned into a regression test (see testdata/malformed).
+// Returns the name of the new file.
+func SaveMalformed(dir string, m MalformedPacket) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	src := strings.NewReplacer(":", "_", ".", "_").Replace(m.SrcAddr)
+	filename := filepath.Join(dir, fmt.Sprintf("%s-%s.bin", m.Timestamp.Format("20060102-150405.000000"), src))
+	if err := os.WriteFile(filename, m.Payload, 0o644); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// Splits a domain name, as miekg/dns presents it, into its labels, decoding
+// escapes along the way. An escaped dot (\.) does not end a label, and \DDD
+// is the byte with decimal value DDD, so "Jane's Mac\.home._ssh._tcp.local."
+// has four labels, the first of which is "Jane's Mac.home". A \DDD above 255
+// is not a byte, so like unescapeTXT we treat it as an escaped digit followed
+// by two more.
+func SplitHost(host string) []string {
+	var res []string
+	var label []byte
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		switch {
+		case c == '\\' && isByteEscape(host[i+1:]):
+			n, _ := strconv.Atoi(host[i+1 : i+4])
+			label = append(label, byte(n))
+			i += 3
+		case c == '\\' && i+1 < len(host):
+			label = append(label, host[i+1])
+			i++
+		case c == '.':
+			res = append(res, string(label))
+			label = label[:0]
+		default:
+			label = append(label, c)
+		}
+	}
+	// A trailing dot (for the root) doesn't start another label.
+	if len(label) > 0 || !strings.HasSuffix(host, ".") || len(res) == 0 {
+		res = append(res, string(label))
+	}
+	return res
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
 
-	if len(aParts) != len(bParts) {
+// Reports whether s starts with the DDD of a \DDD escape that fits in a byte.
+func isByteEscape(s string) bool {
+	if len(s) < 3 || !isDigit(s[0]) || !isDigit(s[1]) || !isDigit(s[2]) {
 		return false
 	}
-	for i := range aParts {
-		if aParts[i] != bParts[i] && bParts[i] != "*" {
-			return false
+	n, _ := strconv.Atoi(s[:3])
+	return n <= 255
+}
+
+// The parts of a Service Instance Name (RFC 6763 section 4.3).
+type ServiceInstanceName struct {
+	Instance string // decoded, so it may contain dots and any other characters
+	Service  string // e.g. _airplay._tcp
+	Domain   string // e.g. local
+}
+
+// Parses a Service Instance Name like "Living Room v2\.0._airplay._tcp.local.",
+// returning false if it isn't one.
+func ParseServiceInstanceName(name string) (ServiceInstanceName, bool) {
+	labels := SplitHost(name)
+	if len(labels) < 4 {
+		return ServiceInstanceName{}, false
+	}
+	proto := strings.ToLower(labels[2])
+	if !strings.HasPrefix(labels[1], "_") || (proto != "_tcp" && proto != "_udp") {
+		return ServiceInstanceName{}, false
+	}
+	return ServiceInstanceName{
+		Instance: labels[0],
+		Service:  labels[1] + "." + labels[2],
+		Domain:   strings.Join(labels[3:], "."),
+	}, true
+}
+
+// Parses a reverse-mapping name, like "5.1.168.192.in-addr.arpa." or the 32
+// nibbles of an IPv6 address under ip6.arpa (RFC 3596 section 2.5), returning
+// the address it is for, or false if it isn't one.
+func ParseReverseName(name string) (net.IP, bool) {
+	labels := SplitHost(strings.ToLower(name))
+	switch {
+	case len(labels) == 6 && labels[4] == "in-addr" && labels[5] == "arpa":
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels[:4] {
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil || (len(label) > 1 && label[0] == '0') {
+				return nil, false
+			}
+			ip[3-i] = byte(n)
 		}
+		return ip, true
+	case len(labels) == 34 && labels[32] == "ip6" && labels[33] == "arpa":
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels[:32] {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil, false
+			}
+			// The least significant nibble comes first.
+			if i%2 == 0 {
+				ip[15-i/2] |= byte(n)
+			} else {
+				ip[15-i/2] |= byte(n) << 4
+			}
+		}
+		return ip, true
 	}
-	return true
+	return nil, false
+}
+
+// Checks whether a domain name matches a pattern. See HostPattern for the
+// syntax. Patterns that are used over and over should be compiled once with
+// CompileHostPattern instead.
+func HostMatches(a, b string) bool {
+	pattern, err := CompileHostPattern(b)
+	return err == nil && pattern.Matches(a)
 }
@@ -1,8 +1,17 @@
 package packet
 
 import (
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/bvisness/buongiorno/src/utils"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -58,3 +67,201 @@ func TestHostMatches(t *testing.T) {
 
 	assert.True(t, HostMatches("_services._dns-sd._udp.local", "_services._dns-sd._udp.*"))
 }
+
+func TestReadMDNSFile(t *testing.T) {
+	var query dns.Msg
+	query.SetQuestion("_spotify-connect._tcp.local.", dns.TypePTR)
+	payload, err := query.Pack()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	frame := makeTestFrame(payload)
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(1700000000, 0),
+		CaptureLength: len(frame),
+		Length:        len(frame),
+	}
+
+	check := func(t *testing.T, filename string) {
+		reader, err := ReadMDNSFile(filename)
+		if !assert.Nil(t, err) {
+			return
+		}
+		var got []MDNSPacket
+		for p := range reader.Packets() {
+			got = append(got, p)
+		}
+		if assert.Len(t, got, 1) {
+			assert.True(t, ci.Timestamp.Equal(got[0].Timestamp))
+			assert.Equal(t, "192.168.1.5", got[0].SrcAddr)
+			assert.Equal(t, "224.0.0.251", got[0].DstAddr)
+			assert.Equal(t, 5353, got[0].SrcPort)
+			assert.Equal(t, "a6:d9:07:aa:ac:61", got[0].SrcMAC.String())
+			assert.Equal(t, 255, got[0].TTL)
+			assert.Equal(t, len(frame), got[0].Length)
+			if assert.Len(t, got[0].DNS.Question, 1) {
+				assert.Equal(t, "_spotify-connect._tcp.local.", got[0].DNS.Question[0].Name)
+			}
+		}
+	}
+
+	t.Run("pcap", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "test.pcap")
+		f := utils.Must1(os.Create(filename))
+		w := pcapgo.NewWriter(f)
+		utils.Must(w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+		utils.Must(w.WritePacket(ci, frame))
+		utils.Must(f.Close())
+
+		check(t, filename)
+	})
+	t.Run("pcapng", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "test.pcapng")
+		f := utils.Must1(os.Create(filename))
+		w := utils.Must1(pcapgo.NewNgWriter(f, layers.LinkTypeEthernet))
+		utils.Must(w.WritePacket(ci, frame))
+		utils.Must(w.Flush())
+		utils.Must(f.Close())
+
+		check(t, filename)
+	})
+	t.Run("malformed", func(t *testing.T) {
+		// Cut the packet off in the middle of the question name
+		cut := len(payload) - 20
+		truncated := frame[:len(frame)-cut]
+		filename := filepath.Join(t.TempDir(), "malformed.pcap")
+		f := utils.Must1(os.Create(filename))
+		w := pcapgo.NewWriter(f)
+		utils.Must(w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+		utils.Must(w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     ci.Timestamp,
+			CaptureLength: len(truncated),
+			Length:        len(truncated),
+		}, truncated))
+		utils.Must(f.Close())
+
+		reader, err := ReadMDNSFile(filename)
+		if !assert.Nil(t, err) {
+			return
+		}
+		for range reader.Packets() {
+			assert.Fail(t, "the malformed packet should not be delivered as a normal packet")
+		}
+		var got []MalformedPacket
+		for m := range reader.Malformed() {
+			got = append(got, m)
+		}
+		if assert.Len(t, got, 1) {
+			assert.Equal(t, "192.168.1.5", got[0].SrcAddr)
+			assert.NotNil(t, got[0].Err)
+			assert.Equal(t, payload[:len(payload)-cut], got[0].Payload)
+		}
+	})
+}
+
+// Wraps a DNS payload in Ethernet, IPv4 and UDP headers, as if it had been
+// multicast by 192.168.1.5.
+func makeTestFrame(payload []byte) []byte {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0xa6, 0xd9, 0x07, 0xaa, 0xac, 0x61},
+		DstMAC:       net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := layers.IPv4{
+		Version:  4,
+		TTL:      255,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(192, 168, 1, 5),
+		DstIP:    net.IPv4(224, 0, 0, 251),
+	}
+	udp := layers.UDP{SrcPort: 5353, DstPort: 5353}
+	udp.SetNetworkLayerForChecksum(&ip)
+	buf := gopacket.NewSerializeBuffer()
+	utils.Must(gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&eth, &ip, &udp, gopacket.Payload(payload),
+	))
+	return buf.Bytes()
+}
+
+// Malformed packets saved by SaveMalformed can be dropped into
+// testdata/malformed to make sure we keep handling them gracefully.
+func TestMalformedFixtures(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/malformed/*.bin")
+	if !assert.Nil(t, err) {
+		return
+	}
+	for _, fixture := range fixtures {
+		t.Run(filepath.Base(fixture), func(t *testing.T) {
+			payload := utils.Must1(os.ReadFile(fixture))
+			_, err := ParsePacket(payload)
+			assert.NotNil(t, err)
+
+			partial, err := ParsePartialPacket(payload)
+			assert.NotNil(t, err)
+			t.Log(partial.String())
+		})
+	}
+}
+
+func TestSaveMalformed(t *testing.T) {
+	dir := t.TempDir()
+	m := MalformedPacket{
+		MDNSPacket: MDNSPacket{
+			Timestamp: time.Unix(1700000000, 0),
+			SrcAddr:   "fe80::14e4:e891:9f5b:86eb",
+		},
+		Payload: []byte{0x00, 0x00, 0x84},
+	}
+	filename, err := SaveMalformed(dir, m)
+	if assert.Nil(t, err) {
+		assert.Equal(t, dir, filepath.Dir(filename))
+		assert.Equal(t, m.Payload, utils.Must1(os.ReadFile(filename)))
+	}
+}
+
+func TestSplitHost(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, SplitHost("a.b.c."))
+	assert.Equal(t, []string{"a", "b", "c"}, SplitHost("a.b.c"))
+	assert.Equal(t, []string{""}, SplitHost("."))
+	assert.Equal(t, []string{"Jane's Mac.home", "_ssh", "_tcp", "local"}, SplitHost(`Jane's Mac\.home._ssh._tcp.local.`))
+	assert.Equal(t, []string{"Living Room", "_airplay", "_tcp", "local"}, SplitHost(`Living\032Room._airplay._tcp.local.`))
+	assert.Equal(t, []string{`back\slash.`, "local"}, SplitHost(`back\\slash\..local.`))
+	assert.Equal(t, []string{"\xff", "300", "local"}, SplitHost(`\255.\300.local.`))
+}
+
+func TestParseServiceInstanceName(t *testing.T) {
+	name, ok := ParseServiceInstanceName(`Living Room v2\.0._airplay._tcp.local.`)
+	assert.True(t, ok)
+	assert.Equal(t, ServiceInstanceName{Instance: "Living Room v2.0", Service: "_airplay._tcp", Domain: "local"}, name)
+
+	name, ok = ParseServiceInstanceName(`Printer\0401._ipp._tcp.example.com.`)
+	assert.True(t, ok)
+	assert.Equal(t, ServiceInstanceName{Instance: "Printer(1", Service: "_ipp._tcp", Domain: "example.com"}, name)
+
+	_, ok = ParseServiceInstanceName("local.")
+	assert.False(t, ok)
+	_, ok = ParseServiceInstanceName("a.b.c.local.")
+	assert.False(t, ok)
+}
+
+func TestParseReverseName(t *testing.T) {
+	ip, ok := ParseReverseName("5.1.168.192.in-addr.arpa.")
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.1.5", ip.String())
+
+	ip, ok = ParseReverseName("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.E.F.ip6.arpa.")
+	assert.True(t, ok)
+	assert.Equal(t, "fe80::1", ip.String())
+
+	for _, name := range []string{
+		"1.168.192.in-addr.arpa.",
+		"256.1.168.192.in-addr.arpa.",
+		"05.1.168.192.in-addr.arpa.",
+		"0.0.0.8.e.f.ip6.arpa.",
+		"_airplay._tcp.local.",
+	} {
+		_, ok := ParseReverseName(name)
+		assert.False(t, ok, name)
+	}
+}
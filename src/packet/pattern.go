@@ -0,0 +1,198 @@
+package packet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A compiled pattern for matching domain names, like "**._tcp.local" or
+// "_ipp*._tcp.*". Patterns are matched label by label, and case-insensitively,
+// as DNS names are:
+//
+//   - * on its own matches any one label
+//   - ** on its own matches one or more labels, and may appear anywhere
+//   - * within a label matches any run of characters, e.g. _ipp* matches _ipp
+//     and _ipps
+//   - \. is a literal dot within a label, \* a literal star, and \DDD the byte
+//     with decimal value DDD, as in the names miekg/dns gives us
+//
+// A HostPattern is safe to use from several goroutines at once.
+type HostPattern struct {
+	pattern string
+	labels  []labelPattern
+}
+
+type labelPattern struct {
+	// Matches one or more whole labels
+	multi bool
+	// The literal pieces of the label, which are separated by wildcards. A
+	// label without wildcards has exactly one piece. Lowercase.
+	pieces []string
+}
+
+func CompileHostPattern(pattern string) (HostPattern, error) {
+	res := HostPattern{pattern: pattern}
+
+	var piece []byte
+	var pieces []string
+	endLabel := func() {
+		pieces = append(pieces, string(piece))
+		label := labelPattern{pieces: pieces}
+		if len(pieces) == 3 && pieces[0] == "" && pieces[1] == "" && pieces[2] == "" {
+			// Escaped stars end up in the pieces, so this can only be an
+			// unescaped **.
+			label = labelPattern{multi: true}
+		}
+		res.labels = append(res.labels, label)
+		piece, pieces = piece[:0], nil
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+3 < len(pattern) && isDigit(pattern[i+1]) && isDigit(pattern[i+2]) && isDigit(pattern[i+3]):
+			n, _ := strconv.Atoi(pattern[i+1 : i+4])
+			if n > 255 {
+				return HostPattern{}, fmt.Errorf("bad escape \\%s in host pattern %q", pattern[i+1:i+4], pattern)
+			}
+			piece = append(piece, lowerASCII(byte(n)))
+			i += 3
+		case c == '\\':
+			if i+1 == len(pattern) {
+				return HostPattern{}, fmt.Errorf("host pattern %q ends with a backslash", pattern)
+			}
+			piece = append(piece, lowerASCII(pattern[i+1]))
+			i++
+		case c == '*':
+			pieces = append(pieces, string(piece))
+			piece = piece[:0]
+		case c == '.':
+			if i == len(pattern)-1 {
+				break // trailing dot for the root
+			}
+			if len(piece) == 0 && len(pieces) == 0 {
+				return HostPattern{}, fmt.Errorf("empty label in host pattern %q", pattern)
+			}
+			endLabel()
+		default:
+			piece = append(piece, lowerASCII(c))
+		}
+	}
+	if len(piece) == 0 && len(pieces) == 0 {
+		return HostPattern{}, fmt.Errorf("empty label in host pattern %q", pattern)
+	}
+	endLabel()
+
+	return res, nil
+}
+
+func MustCompileHostPattern(pattern string) HostPattern {
+	res, err := CompileHostPattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+func (p HostPattern) String() string {
+	return p.pattern
+}
+
+// Checks whether a domain name, as miekg/dns presents it, matches the pattern.
+func (p HostPattern) Matches(name string) bool {
+	// Most names have only a handful of labels, which fit on the stack.
+	var buf [16]string
+	labels := appendLabels(buf[:0], name)
+	return matchLabels(p.labels, labels)
+}
+
+func matchLabels(patterns []labelPattern, labels []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0].multi {
+			// Try every number of labels, leaving enough for the rest of the
+			// pattern.
+			for n := 1; n <= len(labels); n++ {
+				if matchLabels(patterns[1:], labels[n:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(labels) == 0 || !patterns[0].matches(labels[0]) {
+			return false
+		}
+		patterns, labels = patterns[1:], labels[1:]
+	}
+	return len(labels) == 0
+}
+
+func (l labelPattern) matches(label string) bool {
+	if len(l.pieces) == 1 {
+		return equalFoldASCII(label, l.pieces[0])
+	}
+
+	first, last := l.pieces[0], l.pieces[len(l.pieces)-1]
+	if len(label) < len(first)+len(last) ||
+		!equalFoldASCII(label[:len(first)], first) ||
+		!equalFoldASCII(label[len(label)-len(last):], last) {
+		return false
+	}
+	rest := label[len(first) : len(label)-len(last)]
+	for _, piece := range l.pieces[1 : len(l.pieces)-1] {
+		i := indexFoldASCII(rest, piece)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(piece):]
+	}
+	return true
+}
+
+// Like SplitHost, but appends to a slice, and doesn't allocate unless the name
+// has escapes.
+func appendLabels(res []string, name string) []string {
+	if strings.IndexByte(name, '\\') >= 0 {
+		return append(res, SplitHost(name)...)
+	}
+	name = strings.TrimSuffix(name, ".")
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return append(res, name)
+		}
+		res = append(res, name[:i])
+		name = name[i+1:]
+	}
+}
+
+// DNS names are only case-insensitive for ASCII letters (RFC 4343).
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// Compares s with lower, which must already be lowercase.
+func equalFoldASCII(s, lower string) bool {
+	if len(s) != len(lower) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if lowerASCII(s[i]) != lower[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func indexFoldASCII(s, lower string) int {
+	for i := 0; i+len(lower) <= len(s); i++ {
+		if equalFoldASCII(s[i:i+len(lower)], lower) {
+			return i
+		}
+	}
+	return -1
+}
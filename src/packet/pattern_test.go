@@ -0,0 +1,64 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostPattern(t *testing.T) {
+	matches := func(name, pattern string) bool {
+		return MustCompileHostPattern(pattern).Matches(name)
+	}
+
+	// Escaped dots are part of a label
+	assert.True(t, matches(`Living Room v2\.0._airplay._tcp.local.`, "*._airplay._tcp.local"))
+	assert.False(t, matches(`Living Room v2\.0._airplay._tcp.local.`, "*.*._airplay._tcp.local"))
+	assert.True(t, matches(`a\.b.local`, `a\.b.local`))
+	assert.True(t, matches(`a\046b.local`, `a\.b.local`))
+
+	// Case-insensitive
+	assert.True(t, matches("_AirPlay._TCP.local.", "**._tcp.local"))
+	assert.True(t, matches("_airplay._tcp.local.", "_AirPlay._tcp.LOCAL"))
+
+	// ** anywhere
+	assert.True(t, matches("_universal._sub._ipp._tcp.local", "_universal.**.local"))
+	assert.True(t, matches("a.b.c.d.e", "a.**.c.**"))
+	assert.False(t, matches("a.c", "a.**.c"))
+	assert.True(t, matches("a.b.c", "**.**"))
+	assert.False(t, matches("a", "**.**"))
+
+	// Globs within labels
+	assert.True(t, matches("_ipp._tcp.local", "_ipp*._tcp.local"))
+	assert.True(t, matches("_ipps._tcp.local", "_ipp*._tcp.local"))
+	assert.False(t, matches("_http._tcp.local", "_ipp*._tcp.local"))
+	assert.True(t, matches("MacBook-Pro-3.local", "macbook*pro*.local"))
+	assert.False(t, matches("MacBook-3.local", "macbook*pro*.local"))
+	assert.True(t, matches("ab.local", "a*b.local"))
+	assert.False(t, matches("a.local", "a*a.local"))
+
+	// Escapes, in both the name and the pattern
+	assert.True(t, matches(`Living Room v2\.0._airplay._tcp.local.`, `*v2\.0._airplay._tcp.local`))
+	assert.True(t, matches(`Living\032Room._airplay._tcp.local.`, `living room._airplay._tcp.local`))
+	assert.True(t, matches("a*b.local", `a\*b.local`))
+	assert.False(t, matches("axb.local", `a\*b.local`))
+
+	for _, bad := range []string{"", ".", "a..b", `a\`, `a\999`} {
+		_, err := CompileHostPattern(bad)
+		assert.NotNil(t, err, "pattern %q", bad)
+	}
+}
+
+func BenchmarkHostPattern(b *testing.B) {
+	pattern := MustCompileHostPattern("**._tcp.local")
+	names := []string{
+		"MacBook Pro (3)._airplay._tcp.local.",
+		"_services._dns-sd._udp.local.",
+		"MacBook-Pro-3.local.",
+		"_universal._sub._ipp._tcp.local.",
+	}
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		pattern.Matches(names[i%len(names)])
+	}
+}
@@ -0,0 +1,210 @@
+package packet
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/utils"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// How long we hold on to incomplete IPv4 fragments before giving up on them.
+const fragmentTimeout = 30 * time.Second
+
+// Turns captured frames into mDNS packets, reassembling fragmented IPv4
+// datagrams along the way. Large announcements (e.g. AirPlay TXT records) can
+// easily exceed the MTU. IPv6 fragments are not reassembled.
+//
+// Not safe for concurrent use; each capture loop should have its own.
+type frameDecoder struct {
+	defrag      *ip4defrag.IPv4Defragmenter
+	lastDiscard time.Time
+
+	// The frames of the datagrams being reassembled, so that the original
+	// frames can be recorded.
+	fragments map[fragmentKey][]MDNSPacket
+}
+
+// Identifies the datagram a fragment belongs to (RFC 791).
+type fragmentKey struct {
+	src, dst string
+	id       uint16
+	protocol layers.IPProtocol
+}
+
+func newFrameDecoder() *frameDecoder {
+	return &frameDecoder{
+		defrag:    ip4defrag.NewIPv4Defragmenter(),
+		fragments: make(map[fragmentKey][]MDNSPacket),
+	}
+}
+
+// Like decodeUDP, but also returns false for fragments of a datagram that is
+// not yet complete. No single captured frame has the whole of a reassembled
+// datagram, so instead of RawData it gets the frames of its fragments.
+func (d *frameDecoder) decode(packet gopacket.Packet, linkType layers.LinkType) (MDNSPacket, []byte, bool) {
+	ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
+	if ipv4Layer == nil {
+		return decodeUDP(packet, linkType)
+	}
+	ip, _ := ipv4Layer.(*layers.IPv4)
+	if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+		return decodeUDP(packet, linkType)
+	}
+
+	ts := packet.Metadata().Timestamp
+	if ts.Sub(d.lastDiscard) > fragmentTimeout {
+		cutoff := ts.Add(-fragmentTimeout)
+		d.defrag.DiscardOlderThan(cutoff)
+		for key, frames := range d.fragments {
+			if frames[len(frames)-1].Timestamp.Before(cutoff) {
+				delete(d.fragments, key)
+			}
+		}
+		d.lastDiscard = ts
+	}
+
+	key := fragmentKey{src: ip.SrcIP.String(), dst: ip.DstIP.String(), id: ip.Id, protocol: ip.Protocol}
+	d.fragments[key] = append(d.fragments[key], MDNSPacket{
+		Timestamp: ts,
+		Length:    utils.OrDefault(packet.Metadata().Length, len(packet.Data())),
+		LinkType:  linkType,
+		RawData:   packet.Data(),
+	})
+
+	whole, err := d.defrag.DefragIPv4WithTimestamp(ip, ts)
+	if err != nil {
+		log.Printf("ERROR: failed to reassemble IPv4 fragments from %s: %v", ip.SrcIP, err)
+		delete(d.fragments, key)
+		return MDNSPacket{}, nil, false
+	} else if whole == nil {
+		return MDNSPacket{}, nil, false
+	}
+	fragments := d.fragments[key]
+	delete(d.fragments, key)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, whole, gopacket.Payload(whole.Payload)); err != nil {
+		log.Printf("ERROR: failed to rebuild reassembled datagram from %s: %v", ip.SrcIP, err)
+		return MDNSPacket{}, nil, false
+	}
+	data := buf.Bytes()
+	reassembled := gopacket.NewPacket(data, layers.LinkTypeRaw, gopacket.Default)
+	reassembled.Metadata().CaptureInfo = gopacket.CaptureInfo{
+		Timestamp:     ts,
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+
+	res, payload, ok := decodeUDP(reassembled, layers.LinkTypeRaw)
+	if !ok || (res.SrcPort != mdnsPort && res.DstPort != mdnsPort) {
+		// Our capture filter lets through all fragments, not just mDNS ones.
+		return MDNSPacket{}, nil, false
+	}
+	decodeLink(packet, &res)
+	res.LinkType, res.RawData = linkType, nil
+	res.Fragments = fragments
+	return res, payload, true
+}
+
+// How long to wait for the rest of a truncated query. RFC 6762 section 7.2 asks
+// responders to wait 400-500ms.
+const tcWait = 500 * time.Millisecond
+
+// When a querier has more known answers than fit in one packet, it sets the TC
+// bit and sends the rest in following queries with no questions (RFC 6762
+// section 7.2). A tcReassembler merges those back into a single packet, so that
+// the whole known-answer list is processed together.
+//
+// Packets that arrive while a query is held are held behind it, so that
+// packets still come out in the order they were sent. Otherwise, responses to
+// a truncated query would be processed before the query itself.
+type tcReassembler struct {
+	queue   []*heldPacket
+	pending map[string]*heldPacket // incomplete queries, keyed by source address and port
+}
+
+type heldPacket struct {
+	p        MDNSPacket
+	lastSeen time.Time
+	done     bool // if set, the packet can be emitted once everything before it has been
+}
+
+// Adds a packet, returning the packets that are now ready to be emitted, in
+// order. The result is empty if the packet is being held, either for its own
+// continuations or behind an earlier query.
+func (r *tcReassembler) add(p MDNSPacket) []MDNSPacket {
+	if r.pending == nil {
+		r.pending = make(map[string]*heldPacket)
+	}
+	key := net.JoinHostPort(p.SrcAddr, strconv.Itoa(p.SrcPort))
+
+	if pending, ok := r.pending[key]; ok && !p.DNS.Response {
+		if len(p.DNS.Question) == 0 {
+			mergeContinuation(&pending.p, p)
+			pending.lastSeen = p.Timestamp
+			if !p.DNS.Truncated {
+				pending.done = true
+				delete(r.pending, key)
+			}
+			return r.ready()
+		}
+
+		// A new query, so the querier must have given up on the old one.
+		pending.done = true
+		delete(r.pending, key)
+	}
+
+	held := &heldPacket{p: p, lastSeen: p.Timestamp, done: true}
+	if p.DNS.Truncated && !p.DNS.Response {
+		held.done = false
+		r.pending[key] = held
+	}
+	r.queue = append(r.queue, held)
+	return r.ready()
+}
+
+// Removes the packets at the front of the queue that are done.
+func (r *tcReassembler) ready() []MDNSPacket {
+	var res []MDNSPacket
+	for len(r.queue) > 0 && r.queue[0].done {
+		res = append(res, r.queue[0].p)
+		r.queue = r.queue[1:]
+	}
+	return res
+}
+
+func mergeContinuation(p *MDNSPacket, cont MDNSPacket) {
+	p.DNS.Answer = append(p.DNS.Answer, cont.DNS.Answer...)
+	p.DNS.Ns = append(p.DNS.Ns, cont.DNS.Ns...)
+	p.DNS.Extra = append(p.DNS.Extra, cont.DNS.Extra...)
+	p.DNS.Truncated = cont.DNS.Truncated
+	p.Continuations = append(p.Continuations, cont)
+}
+
+// Gives up on the queries whose continuations have not arrived in time, and
+// returns the packets that are now ready to be emitted, in order.
+func (r *tcReassembler) expire(now time.Time) []MDNSPacket {
+	for key, pending := range r.pending {
+		if now.Sub(pending.lastSeen) >= tcWait {
+			pending.done = true
+			delete(r.pending, key)
+		}
+	}
+	return r.ready()
+}
+
+// Returns all held packets, in order.
+func (r *tcReassembler) flush() []MDNSPacket {
+	var res []MDNSPacket
+	for _, held := range r.queue {
+		res = append(res, held.p)
+	}
+	r.queue, r.pending = nil, nil
+	return res
+}
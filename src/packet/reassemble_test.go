@@ -0,0 +1,203 @@
+package packet
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bvisness/buongiorno/src/utils"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// Splits the IP datagram in a frame from makeTestFrame into several frames.
+func fragmentTestFrame(frame []byte, fragmentSize int) [][]byte {
+	packet := gopacket.NewPacket(frame, layers.LinkTypeEthernet, gopacket.Default)
+	eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+
+	var res [][]byte
+	data := ip.Payload
+	for off := 0; off < len(data); off += fragmentSize {
+		end := min(off+fragmentSize, len(data))
+		fragIP := *ip
+		fragIP.Id = 1234
+		fragIP.FragOffset = uint16(off / 8)
+		fragIP.Flags = 0
+		if end < len(data) {
+			fragIP.Flags = layers.IPv4MoreFragments
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		utils.Must(gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			eth, &fragIP, gopacket.Payload(data[off:end]),
+		))
+		res = append(res, buf.Bytes())
+	}
+	return res
+}
+
+func TestFragmentedDatagram(t *testing.T) {
+	var announcement dns.Msg
+	announcement.Response = true
+	announcement.Answer = append(announcement.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "Living Room._airplay._tcp.local.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 4500},
+		Txt: []string{strings.Repeat("a", 250), strings.Repeat("b", 250), strings.Repeat("c", 250), strings.Repeat("d", 250)},
+	})
+	payload, err := announcement.Pack()
+	if !assert.Nil(t, err) {
+		return
+	}
+	fragments := fragmentTestFrame(makeTestFrame(payload), 400)
+	assert.Equal(t, 3, len(fragments))
+
+	filename := filepath.Join(t.TempDir(), "fragments.pcap")
+	f, err := os.Create(filename)
+	if !assert.Nil(t, err) {
+		return
+	}
+	w := pcapgo.NewWriter(f)
+	utils.Must(w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+	start := time.Unix(1700000000, 0)
+	for i, fragment := range fragments {
+		utils.Must(w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     start.Add(time.Duration(i) * time.Millisecond),
+			CaptureLength: len(fragment),
+			Length:        len(fragment),
+		}, fragment))
+	}
+	utils.Must(f.Close())
+
+	packets := readAll(t, filename)
+	if !assert.Equal(t, 1, len(packets)) {
+		return
+	}
+	p := packets[0]
+	assert.Equal(t, "192.168.1.5", p.SrcAddr)
+	assert.Equal(t, 5353, p.SrcPort)
+	assert.Equal(t, net.HardwareAddr{0xa6, 0xd9, 0x07, 0xaa, 0xac, 0x61}, p.SrcMAC)
+	assert.Equal(t, layers.LinkTypeEthernet, p.LinkType)
+	assert.Nil(t, p.RawData)
+	if assert.Equal(t, len(fragments), len(p.Fragments)) {
+		for i, fragment := range fragments {
+			assert.Equal(t, fragment, p.Fragments[i].RawData)
+			assert.True(t, start.Add(time.Duration(i)*time.Millisecond).Equal(p.Fragments[i].Timestamp))
+		}
+	}
+	if assert.Equal(t, 1, len(p.DNS.Answer)) {
+		assert.Equal(t, announcement.Answer[0].(*dns.TXT).Txt, p.DNS.Answer[0].(*dns.TXT).Txt)
+	}
+
+	// The original fragments should be recorded, and be reassembled again when
+	// read back.
+	recorded := filepath.Join(t.TempDir(), "recorded.pcapng")
+	r, err := NewRecorder(recorded)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, r.WritePacket(p))
+	assert.Nil(t, r.Close())
+	if reread := readAll(t, recorded); assert.Equal(t, 1, len(reread)) {
+		assert.Equal(t, p.DNS.Answer[0].String(), reread[0].DNS.Answer[0].String())
+		assert.Equal(t, len(fragments), len(reread[0].Fragments))
+	}
+}
+
+func makeKnownAnswerQuery(ts time.Time, src string, question bool, truncated bool, answers ...string) MDNSPacket {
+	var msg dns.Msg
+	if question {
+		msg.SetQuestion("_airplay._tcp.local.", dns.TypePTR)
+	}
+	msg.Truncated = truncated
+	for _, answer := range answers {
+		msg.Answer = append(msg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: "_airplay._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500},
+			Ptr: answer + "._airplay._tcp.local.",
+		})
+	}
+	return MDNSPacket{Timestamp: ts, SrcAddr: src, SrcPort: 5353, DNS: msg}
+}
+
+func TestTCReassembler(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	ms := func(n int) time.Time { return start.Add(time.Duration(n) * time.Millisecond) }
+
+	t.Run("continuations", func(t *testing.T) {
+		var r tcReassembler
+		assert.Empty(t, r.add(makeKnownAnswerQuery(ms(0), "192.168.1.5", true, true, "A", "B")))
+		assert.Empty(t, r.add(makeKnownAnswerQuery(ms(10), "192.168.1.5", false, true, "C")))
+
+		// Other senders' packets wait behind the held query.
+		other := makeKnownAnswerQuery(ms(20), "192.168.1.6", true, false)
+		assert.Empty(t, r.add(other))
+
+		ready := r.add(makeKnownAnswerQuery(ms(30), "192.168.1.5", false, false, "D"))
+		if !assert.Equal(t, 2, len(ready)) {
+			return
+		}
+		assert.Equal(t, other, ready[1])
+		p := ready[0]
+		assert.Equal(t, ms(0), p.Timestamp)
+		assert.Equal(t, 1, len(p.DNS.Question))
+		assert.Equal(t, 4, len(p.DNS.Answer))
+		assert.False(t, p.DNS.Truncated)
+		assert.Equal(t, 2, len(p.Continuations))
+		assert.Empty(t, r.flush())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		var r tcReassembler
+		assert.Empty(t, r.add(makeKnownAnswerQuery(ms(0), "192.168.1.5", true, true, "A")))
+		assert.Empty(t, r.expire(ms(400)))
+		ready := r.expire(ms(500))
+		if assert.Equal(t, 1, len(ready)) {
+			assert.Equal(t, 1, len(ready[0].DNS.Answer))
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		var r tcReassembler
+		assert.Empty(t, r.add(makeKnownAnswerQuery(ms(0), "192.168.1.5", true, true, "A")))
+
+		// A responder answering before the continuation arrives must not
+		// overtake the query.
+		var msg dns.Msg
+		msg.SetQuestion("_airplay._tcp.local.", dns.TypePTR)
+		msg.Response = true
+		response := MDNSPacket{Timestamp: ms(5), SrcAddr: "192.168.1.7", SrcPort: 5353, DNS: msg}
+		assert.Empty(t, r.add(response))
+
+		ready := r.add(makeKnownAnswerQuery(ms(10), "192.168.1.5", false, false, "B"))
+		if assert.Equal(t, 2, len(ready)) {
+			assert.Equal(t, 2, len(ready[0].DNS.Answer))
+			assert.Equal(t, response, ready[1])
+		}
+		assert.Empty(t, r.flush())
+
+		// The same goes when the query times out instead.
+		assert.Empty(t, r.add(makeKnownAnswerQuery(ms(100), "192.168.1.5", true, true, "A")))
+		assert.Empty(t, r.add(response))
+		assert.Empty(t, r.expire(ms(500)))
+		ready = r.expire(ms(600))
+		if assert.Equal(t, 2, len(ready)) {
+			assert.Equal(t, ms(100), ready[0].Timestamp)
+			assert.Equal(t, response, ready[1])
+		}
+	})
+
+	t.Run("new query", func(t *testing.T) {
+		var r tcReassembler
+		assert.Empty(t, r.add(makeKnownAnswerQuery(ms(0), "192.168.1.5", true, true, "A")))
+		ready := r.add(makeKnownAnswerQuery(ms(10), "192.168.1.5", true, false, "B"))
+		if assert.Equal(t, 2, len(ready)) {
+			assert.Equal(t, ms(0), ready[0].Timestamp)
+			assert.Equal(t, ms(10), ready[1].Timestamp)
+		}
+	})
+}
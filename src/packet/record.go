@@ -0,0 +1,167 @@
+package packet
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// A Recorder writes packets to a pcapng file, keeping their original
+// link-layer data and timestamps so the file can be opened in Wireshark or
+// loaded back into Buongiorno.
+type Recorder struct {
+	f *os.File
+	w *pcapgo.NgWriter
+
+	// pcapng files store the link type per interface, so we create one
+	// interface per link type we see.
+	interfaces map[layers.LinkType]int
+}
+
+func NewRecorder(filename string) (*Recorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		f:          f,
+		interfaces: make(map[layers.LinkType]int),
+	}, nil
+}
+
+// Writes a packet, including the fragments it was reassembled from and any
+// continuations merged into it, to the file. Packets without link-layer data
+// (e.g. ones that did not come from a packet capture) are skipped.
+func (r *Recorder) WritePacket(p MDNSPacket) error {
+	if len(p.RawData) > 0 {
+		intf, err := r.interfaceFor(p.LinkType)
+		if err != nil {
+			return err
+		}
+		err = r.w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:      p.Timestamp,
+			CaptureLength:  len(p.RawData),
+			Length:         max(p.Length, len(p.RawData)),
+			InterfaceIndex: intf,
+		}, p.RawData)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, frag := range p.Fragments {
+		if err := r.WritePacket(frag); err != nil {
+			return err
+		}
+	}
+	for _, cont := range p.Continuations {
+		if err := r.WritePacket(cont); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Recorder) interfaceFor(linkType layers.LinkType) (int, error) {
+	if r.w == nil {
+		// The writer is created lazily since the first interface has to be
+		// provided up front.
+		w, err := pcapgo.NewNgWriter(r.f, linkType)
+		if err != nil {
+			return 0, err
+		}
+		r.w = w
+		r.interfaces[linkType] = 0
+	}
+
+	if id, ok := r.interfaces[linkType]; ok {
+		return id, nil
+	}
+	intf := pcapgo.DefaultNgInterface
+	intf.LinkType = linkType
+	id, err := r.w.AddInterface(intf)
+	if err != nil {
+		return 0, err
+	}
+	r.interfaces[linkType] = id
+	return id, nil
+}
+
+// Flushes everything to disk and closes the file.
+func (r *Recorder) Close() error {
+	if r.w == nil {
+		// Nothing was written, but we still want a valid (empty) file.
+		if _, err := r.interfaceFor(layers.LinkTypeEthernet); err != nil {
+			r.f.Close()
+			return err
+		}
+	}
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// A PacketBuffer keeps the most recent packets in memory, so that they can be
+// saved after something interesting has already happened.
+type PacketBuffer struct {
+	// How far back the buffer goes. Packets older than this (relative to the
+	// newest packet) are discarded.
+	Duration time.Duration
+
+	mu      sync.Mutex
+	packets []MDNSPacket
+}
+
+func NewPacketBuffer(d time.Duration) *PacketBuffer {
+	return &PacketBuffer{Duration: d}
+}
+
+func (b *PacketBuffer) Add(p MDNSPacket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.packets = append(b.packets, p)
+
+	cutoff := p.Timestamp.Add(-b.Duration)
+	numExpired := 0
+	for numExpired < len(b.packets) && b.packets[numExpired].Timestamp.Before(cutoff) {
+		numExpired++
+	}
+	b.packets = b.packets[numExpired:]
+}
+
+// Returns all buffered packets captured at or after the given time.
+func (b *PacketBuffer) Since(t time.Time) []MDNSPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var res []MDNSPacket
+	for _, p := range b.packets {
+		if !p.Timestamp.Before(t) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// Writes all buffered packets captured at or after the given time to a pcapng
+// file.
+func (b *PacketBuffer) Save(filename string, since time.Time) error {
+	r, err := NewRecorder(filename)
+	if err != nil {
+		return err
+	}
+	for _, p := range b.Since(since) {
+		if err := r.WritePacket(p); err != nil {
+			r.Close()
+			return err
+		}
+	}
+	return r.Close()
+}
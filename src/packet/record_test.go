@@ -0,0 +1,87 @@
+package packet
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestPacket(t *testing.T, ts time.Time, service string) MDNSPacket {
+	var query dns.Msg
+	query.SetQuestion(service, dns.TypePTR)
+	payload, err := query.Pack()
+	assert.Nil(t, err)
+	return MDNSPacket{
+		Timestamp: ts,
+		LinkType:  layers.LinkTypeEthernet,
+		RawData:   makeTestFrame(payload),
+	}
+}
+
+func readAll(t *testing.T, filename string) []MDNSPacket {
+	reader, err := ReadMDNSFile(filename)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	var res []MDNSPacket
+	for p := range reader.Packets() {
+		res = append(res, p)
+	}
+	return res
+}
+
+func TestRecorder(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+
+	t.Run("packets", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "rec.pcapng")
+		r, err := NewRecorder(filename)
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Nil(t, r.WritePacket(makeTestPacket(t, start, "_airplay._tcp.local.")))
+		assert.Nil(t, r.WritePacket(MDNSPacket{Timestamp: start}), "packets without link-layer data should be skipped")
+		assert.Nil(t, r.WritePacket(makeTestPacket(t, start.Add(time.Second), "_raop._tcp.local.")))
+		assert.Nil(t, r.Close())
+
+		got := readAll(t, filename)
+		if assert.Len(t, got, 2) {
+			assert.True(t, start.Equal(got[0].Timestamp))
+			assert.Equal(t, "_airplay._tcp.local.", got[0].DNS.Question[0].Name)
+			assert.True(t, start.Add(time.Second).Equal(got[1].Timestamp))
+			assert.Equal(t, "_raop._tcp.local.", got[1].DNS.Question[0].Name)
+		}
+	})
+	t.Run("empty", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "empty.pcapng")
+		r, err := NewRecorder(filename)
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Nil(t, r.Close())
+		assert.Len(t, readAll(t, filename), 0)
+	})
+}
+
+func TestPacketBuffer(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	b := NewPacketBuffer(10 * time.Minute)
+	for i := 0; i < 20; i++ {
+		b.Add(makeTestPacket(t, start.Add(time.Duration(i)*time.Minute), "_airplay._tcp.local."))
+	}
+
+	// Only the last ten minutes (inclusive) should remain.
+	all := b.Since(time.Time{})
+	if assert.Len(t, all, 11) {
+		assert.True(t, start.Add(9*time.Minute).Equal(all[0].Timestamp))
+	}
+	assert.Len(t, b.Since(start.Add(17*time.Minute)), 3)
+
+	filename := filepath.Join(t.TempDir(), "buffer.pcapng")
+	assert.Nil(t, b.Save(filename, start.Add(15*time.Minute)))
+	assert.Len(t, readAll(t, filename), 5)
+}
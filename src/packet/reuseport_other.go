@@ -0,0 +1,11 @@
+//go:build !unix
+
+package packet
+
+import "syscall"
+
+// SO_REUSEPORT is a Unix thing. Elsewhere we just hope that nobody else has
+// the port.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
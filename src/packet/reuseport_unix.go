@@ -0,0 +1,25 @@
+//go:build unix
+
+package packet
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Allows several sockets to bind the same address and port, so that we can
+// listen alongside the system's own mDNS responder.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if sockErr == nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,109 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AllenDang/cimgui-go/imgui"
+	"github.com/bvisness/buongiorno/src/discovery"
+	"github.com/miekg/dns"
+)
+
+var onlyUnansweredQuestions bool
+
+// Lists recent questions with who answered them and how quickly, for tracking
+// down slow discovery.
+func queriesUI(state *discovery.State) {
+	unanswered := state.UnansweredQuestions()
+	title := fmt.Sprintf("Queries (%d unanswered)###Queries", len(unanswered))
+	if imgui.Begin(title) {
+		if imgui.TreeNodeExStrStr("responders", 0, fmt.Sprintf("Responders (%d)", len(state.Latencies))) {
+			imgui.BeginTableV("responders", 6, imgui.TableFlagsSizingFixedFit|imgui.TableFlagsBorders|imgui.TableFlagsRowBg, imgui.NewVec2(0, 0), 0)
+			imgui.TableSetupColumn("Responder")
+			imgui.TableSetupColumn("Answers")
+			imgui.TableSetupColumn("Min")
+			imgui.TableSetupColumn("Mean")
+			imgui.TableSetupColumn("Max")
+			imgui.TableSetupColumn("Late")
+			imgui.TableHeadersRow()
+			for _, l := range state.Latencies {
+				imgui.TableNextRow()
+				imgui.TableNextColumn()
+				imgui.Text(l.Responder)
+				imgui.TableNextColumn()
+				imgui.Text(fmt.Sprint(l.Answers))
+				imgui.TableNextColumn()
+				imgui.Text(formatLatency(l.Min))
+				imgui.TableNextColumn()
+				imgui.Text(formatLatency(l.Mean()))
+				imgui.TableNextColumn()
+				imgui.Text(formatLatency(l.Max))
+				imgui.TableNextColumn()
+				imgui.Text(fmt.Sprint(l.Late))
+			}
+			imgui.EndTable()
+			imgui.TreePop()
+		}
+
+		imgui.Checkbox("Only unanswered", &onlyUnansweredQuestions)
+		questions := state.Questions
+		if onlyUnansweredQuestions {
+			questions = unanswered
+		}
+
+		imgui.BeginTableV("questions", 6, imgui.TableFlagsSizingFixedFit|imgui.TableFlagsResizable|imgui.TableFlagsBorders|imgui.TableFlagsRowBg, imgui.NewVec2(0, 0), 0)
+		imgui.TableSetupColumn("Time")
+		imgui.TableSetupColumn("Asker")
+		imgui.TableSetupColumn("Question")
+		imgui.TableSetupColumn("Type")
+		imgui.TableSetupColumn("QU/QM")
+		imgui.TableSetupColumn("Responders")
+		imgui.TableHeadersRow()
+
+		// Newest first
+		for i := len(questions) - 1; i >= 0; i-- {
+			q := questions[i]
+			imgui.TableNextRow()
+			imgui.TableNextColumn()
+			imgui.Text(formatLastSeen(q.Asked))
+			imgui.TableNextColumn()
+			imgui.Text(q.Asker)
+			imgui.TableNextColumn()
+			imgui.Text(q.Name)
+			imgui.TableNextColumn()
+			imgui.Text(dns.Type(q.Type).String())
+			imgui.TableNextColumn()
+			imgui.Text(q.Mode())
+			imgui.TableNextColumn()
+
+			var responders []string
+			for _, a := range q.Answers {
+				responder := fmt.Sprintf("%s in %s", a.Responder, formatLatency(a.Latency))
+				if a.Unicast {
+					responder += " (unicast)"
+				}
+				if a.Late {
+					responder += " (late)"
+				}
+				responders = append(responders, responder)
+			}
+			switch {
+			case len(responders) > 0:
+				imgui.Text(strings.Join(responders, ", "))
+			case q.KnownAnswers > 0:
+				imgui.TextDisabled(fmt.Sprintf("None needed, %d known", q.KnownAnswers))
+			case q.Expired(state.Now):
+				imgui.Text("Unanswered!")
+			default:
+				imgui.TextDisabled("Waiting...")
+			}
+		}
+		imgui.EndTable()
+	}
+	imgui.End()
+}
+
+func formatLatency(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
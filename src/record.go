@@ -0,0 +1,111 @@
+package src
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AllenDang/cimgui-go/imgui"
+	"github.com/bvisness/buongiorno/src/packet"
+)
+
+// How much live traffic we keep in memory, so it can be saved after the fact.
+const rollingBufferDuration = 30 * time.Minute
+
+var (
+	recordingMu       sync.Mutex
+	recorder          *packet.Recorder
+	recordingFilename string
+	recordedPackets   int
+
+	rollingBuffer       = packet.NewPacketBuffer(rollingBufferDuration)
+	saveMinutes   int32 = 5
+
+	// Shown in the UI after starting/stopping a recording or saving the buffer.
+	recordStatus string
+)
+
+// Called for every packet from the live capture.
+func recordPacket(p packet.MDNSPacket) {
+	rollingBuffer.Add(p)
+
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+	if recorder != nil {
+		if err := recorder.WritePacket(p); err != nil {
+			log.Printf("ERROR: Failed to record packet: %v", err)
+		} else {
+			recordedPackets += 1
+		}
+	}
+}
+
+func captureFilename(prefix string) string {
+	return fmt.Sprintf("%s-%s.pcapng", prefix, time.Now().Format("20060102-150405"))
+}
+
+func startRecording() {
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+
+	filename := captureFilename("buongiorno")
+	r, err := packet.NewRecorder(filename)
+	if err != nil {
+		recordStatus = fmt.Sprintf("Failed to start recording: %v", err)
+		return
+	}
+	recorder = r
+	recordingFilename = filename
+	recordedPackets = 0
+	recordStatus = ""
+}
+
+func stopRecording() {
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+
+	if err := recorder.Close(); err != nil {
+		recordStatus = fmt.Sprintf("Failed to save recording: %v", err)
+	} else {
+		recordStatus = fmt.Sprintf("Saved %d packets to %s", recordedPackets, recordingFilename)
+	}
+	recorder = nil
+}
+
+func recordUI() {
+	recordingMu.Lock()
+	recording, filename, count := recorder != nil, recordingFilename, recordedPackets
+	recordingMu.Unlock()
+
+	if recording {
+		if imgui.Button("Stop recording") {
+			stopRecording()
+		}
+		imgui.SameLine()
+		imgui.Text(fmt.Sprintf("Recording to %s (%d packets)", filename, count))
+	} else {
+		if imgui.Button("Record") {
+			startRecording()
+		}
+	}
+
+	if imgui.Button("Save last") {
+		filename := captureFilename("buongiorno-last")
+		since := time.Now().Add(-time.Duration(saveMinutes) * time.Minute)
+		if err := rollingBuffer.Save(filename, since); err != nil {
+			recordStatus = fmt.Sprintf("Failed to save buffer: %v", err)
+		} else {
+			recordStatus = fmt.Sprintf("Saved last %d minutes to %s", saveMinutes, filename)
+		}
+	}
+	imgui.SameLine()
+	imgui.SetNextItemWidth(100)
+	if imgui.InputInt("minutes", &saveMinutes) {
+		saveMinutes = max(1, min(saveMinutes, int32(rollingBufferDuration/time.Minute)))
+	}
+
+	if recordStatus != "" {
+		imgui.Text(recordStatus)
+	}
+}
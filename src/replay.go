@@ -0,0 +1,268 @@
+package src
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AllenDang/cimgui-go/imgui"
+	"github.com/bvisness/buongiorno/src/packet"
+)
+
+// A Replay plays back the packets from a capture file at the pace they were
+// originally captured (scaled by a speed factor), so you can watch the network
+// come together over time.
+type Replay struct {
+	Source *CaptureSource
+	// If set, packets are stamped with the time they are replayed rather than
+	// the time they were captured, so that they can be mixed with other
+	// sources.
+	Rebase bool
+
+	mu      sync.Mutex
+	packets []packet.MDNSPacket
+	loaded  bool
+	pos     int       // index of the next packet to send
+	clock   time.Time // the capture time we have replayed up to
+	playing bool
+	speed   float32
+
+	// Seeks and steps are requested by the UI, but carried out by the replay
+	// goroutine, since sending the packets can take a while. A pendingSeek of
+	// -1 means there is none.
+	pendingSeek  int
+	pendingSteps int
+	wake         chan struct{}
+
+	// While the seek slider is being dragged, we only remember where it is,
+	// and rebuild state once it is released.
+	seekTarget int32
+	seeking    bool
+
+	// The interfaces to reset our own host with on seeks, as of when the
+	// replay started.
+	interfaces []string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+var currentReplay *Replay
+
+// How often the replay checks for packets that are due.
+const replayTickInterval = 10 * time.Millisecond
+
+// Starts replaying the packets from one or more sources, merged in timestamp
+// order. The packets are read into memory first so that we can seek around in
+// them. See Replay.Rebase for rebase.
+func NewReplay(source *CaptureSource, rebase bool, sources ...packet.Source) *Replay {
+	r := &Replay{
+		Source:  source,
+		Rebase:  rebase,
+		playing: true,
+		speed:   1,
+
+		interfaces:  LiveCaptureConfig().Interfaces,
+		pendingSeek: -1,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	go r.run(sources)
+	return r
+}
+
+// Stops the replay for good. It is safe to call Stop more than once.
+func (r *Replay) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.Source.Done.Store(true)
+	})
+}
+
+func (r *Replay) run(sources []packet.Source) {
+	var all []packet.MDNSPacket
+	for _, packets := range sources {
+		go collectMalformedPackets(r.Source, packets.Malformed())
+		for p := range packets.Packets() {
+			all = append(all, p)
+		}
+	}
+	slices.SortStableFunc(all, func(a, b packet.MDNSPacket) int { return a.Timestamp.Compare(b.Timestamp) })
+
+	r.mu.Lock()
+	r.packets = all
+	r.loaded = true
+	if len(all) > 0 {
+		r.clock = all[0].Timestamp
+	}
+	r.mu.Unlock()
+
+	t := time.NewTicker(replayTickInterval)
+	defer t.Stop()
+	last := time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-r.stop:
+			return
+		case now = <-t.C:
+		case <-r.wake:
+			now = time.Now()
+		}
+
+		reset, batch := r.advance(now.Sub(last))
+		last = now
+		if reset {
+			select {
+			case captureEvents <- captureEvent{Reset: true, Interfaces: r.interfaces}:
+			case <-r.stop:
+				return
+			}
+		}
+		for _, p := range batch {
+			if r.Rebase {
+				p = p.Shifted(now.Sub(p.Timestamp))
+			}
+			select {
+			case captureEvents <- captureEvent{Source: r.Source, Packet: p}:
+			case <-r.stop:
+				return
+			}
+		}
+	}
+}
+
+// Works out which packets are due after some wall-clock time has passed, and
+// moves the replay past them. The packets are sent by the caller, without
+// holding r.mu, so that the UI never waits on the capture pipeline. If reset is
+// set, the state must be reset before they are sent.
+func (r *Replay) advance(elapsed time.Duration) (reset bool, batch []packet.MDNSPacket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start := r.pos
+	if r.pendingSeek >= 0 {
+		// Rebuild our state from scratch so that it contains exactly the
+		// first pendingSeek packets of the capture.
+		reset, start = true, 0
+		r.pos = max(0, min(r.pendingSeek, len(r.packets)))
+		if r.pos > 0 {
+			r.clock = r.packets[r.pos-1].Timestamp
+		} else if len(r.packets) > 0 {
+			r.clock = r.packets[0].Timestamp
+		}
+		r.pendingSeek, r.pendingSteps = -1, 0
+	}
+	for ; r.pendingSteps > 0 && r.pos < len(r.packets); r.pendingSteps-- {
+		r.clock = r.packets[r.pos].Timestamp
+		r.pos++
+	}
+	r.pendingSteps = 0
+
+	if r.playing {
+		r.clock = r.clock.Add(time.Duration(float64(elapsed) * float64(r.speed)))
+		for r.pos < len(r.packets) && !r.packets[r.pos].Timestamp.After(r.clock) {
+			r.pos++
+		}
+		if r.pos >= len(r.packets) {
+			r.playing = false
+		}
+	}
+	r.Source.Done.Store(r.pos >= len(r.packets))
+
+	return reset, r.packets[start:r.pos]
+}
+
+// Asks the replay goroutine to pick up a pending seek or step right away.
+// Must be called with r.mu held.
+func (r *Replay) poke() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Replay) SetPlaying(playing bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if playing && r.pos >= len(r.packets) {
+		// Start over from the beginning, like any media player would.
+		r.seek(0)
+	}
+	r.playing = playing
+}
+
+// Sends exactly one packet, regardless of its timestamp, and pauses.
+func (r *Replay) Step() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.playing = false
+	r.pendingSteps++
+	r.poke()
+}
+
+// Rebuilds our state from scratch so that it contains exactly the first pos
+// packets of the capture. This happens in the background.
+func (r *Replay) Seek(pos int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seek(pos)
+}
+
+// Must be called with r.mu held.
+func (r *Replay) seek(pos int) {
+	if !r.loaded {
+		return
+	}
+	r.pendingSeek = pos
+	r.pendingSteps = 0
+	r.poke()
+}
+
+// Draws the transport bar for the replay.
+func (r *Replay) UI() {
+	r.mu.Lock()
+	loaded, playing, pos, total, speed := r.loaded, r.playing, r.pos, len(r.packets), r.speed
+	var elapsed, duration time.Duration
+	if total > 0 {
+		elapsed = r.clock.Sub(r.packets[0].Timestamp)
+		duration = r.packets[total-1].Timestamp.Sub(r.packets[0].Timestamp)
+	}
+	r.mu.Unlock()
+
+	if !loaded {
+		imgui.Text("Loading replay...")
+		return
+	}
+
+	if playing {
+		if imgui.Button("Pause") {
+			r.SetPlaying(false)
+		}
+	} else {
+		if imgui.Button("Play") {
+			r.SetPlaying(true)
+		}
+	}
+	imgui.SameLine()
+	if imgui.Button("Step") {
+		r.Step()
+	}
+	imgui.SameLine()
+	imgui.Text(fmt.Sprintf("%s / %s", elapsed.Round(100*time.Millisecond), duration.Round(100*time.Millisecond)))
+
+	if !r.seeking {
+		r.seekTarget = int32(pos)
+	}
+	imgui.SliderIntV("Packet", &r.seekTarget, 0, int32(total), "%d", 0)
+	r.seeking = imgui.IsItemActive()
+	if imgui.IsItemDeactivatedAfterEdit() {
+		r.Seek(int(r.seekTarget))
+	}
+	if imgui.SliderFloatV("Speed", &speed, 0.1, 100, "%.1fx", imgui.SliderFlagsLogarithmic) {
+		r.mu.Lock()
+		r.speed = speed
+		r.mu.Unlock()
+	}
+}
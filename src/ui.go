@@ -13,18 +13,22 @@ import (
 	"net"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/AllenDang/cimgui-go/backend"
 	"github.com/AllenDang/cimgui-go/imgui"
-	"github.com/bvisness/buongiorno/src/packet"
+	"github.com/bvisness/buongiorno/src/discovery"
 	"github.com/bvisness/buongiorno/src/utils"
 	"github.com/miekg/dns"
 )
 
 var (
+	// Refreshed in the background, so guarded by avahiMu.
+	avahiMu       sync.Mutex
 	avahiServices []AvahiService
-	serviceTypes  = utils.GroupIntoMap(getAvahiServiceTypes(), func(t AvahiServiceType) string {
+
+	serviceTypes = utils.GroupIntoMap(getAvahiServiceTypes(), func(t AvahiServiceType) string {
 		return t.DNSSDName
 	})
 
@@ -50,51 +54,12 @@ var (
 	iconSize = imgui.NewVec2(24, 24)
 
 	lastFrame time.Time
-)
-
-type ServiceInstance struct {
-	InstanceName string
-	ServiceType  string // the raw DNS-SD service type, e.g. _airplay._tcp
-	Domain       string // should always be "local" for this project
-
-	Host string // Optional. Will be filled in by a corresponding SRV record.
-	Port int    // Optional. Will be filled in by a corresponding SRV record.
-
-	Extras []string // May be filled in by a corresponding TXT record.
-
-	RawName string // the raw Service Instance Name from the PTR record
-}
-
-type Host struct {
-	Name     string
-	IPv4Addr string
-	IPv6Addr string
 
-	// Node graph stuff
-	Pos, Vel     imgui.Vec2
-	ServiceIcons []ServiceIcon
-}
+	// If set, packets will be read from this .pcap or .pcapng file instead of
+	// being captured live.
+	CaptureFile string
 
-type ServiceIcon struct {
-	ServiceType string
-	Position    imgui.Vec2
-}
-
-type ServiceQuery struct {
-	SourceAddr  string
-	ServiceType string // the raw DNS-SD service type, e.g. _airplay._tcp
-
-	RawQuery string
-}
-
-var (
-	serviceInstances []ServiceInstance
-	hosts            []Host
-	serviceQueries   []ServiceQuery
-
-	// SRV and TXT records are deferred to the end of packet processing to ensure
-	// that we always process their info after any PTRs.
-	deferredRRs []dns.RR
+	engine = discovery.NewEngine()
 )
 
 func init() {
@@ -104,66 +69,75 @@ func init() {
 	// 	Host{Name: "c"},
 	// )
 
-	me := Host{Name: "This PC"}
-	if en0, err := net.InterfaceByName("en0"); err != nil {
-		if addrs, err := en0.Addrs(); err != nil {
-			for _, addr := range addrs {
-				var ip net.IP
-				switch addr := addr.(type) {
-				case *net.IPNet:
-					ip = addr.IP
-				case *net.IPAddr:
-					ip = addr.IP
-				}
-
-				if ip.To4() == nil {
-					me.IPv6Addr = ip.String()
-				} else {
-					me.IPv4Addr = ip.String()
-				}
-			}
-		} else {
-			log.Print("No addrs found for interface en0")
-		}
-	} else {
-		log.Print("No interface found named en0")
-	}
-	hosts = append(hosts, me)
-
 	go func() {
 		t := utils.NewInstaTicker(time.Second * 1)
 		for range t.C {
-			svcs := getAvahiServices()
-			avahiServices = <-svcs
+			svcs := <-getAvahiServices()
+			avahiMu.Lock()
+			avahiServices = svcs
+			avahiMu.Unlock()
 		}
 	}()
 }
 
-func serviceQueriesForHost(host Host) []ServiceQuery {
-	var res []ServiceQuery
-	seen := make(map[string]struct{})
-	for _, query := range serviceQueries {
-		if query.SourceAddr != host.IPv4Addr && query.SourceAddr != host.IPv6Addr {
+// Creates the Host for the machine we are running on, using the addresses of
+// the interfaces we are capturing on.
+func thisPC(interfaces []string) discovery.Host {
+	me := discovery.Host{Name: "This PC"}
+	var ipv6 []discovery.HostAddress
+
+	var intfs []net.Interface
+	if len(interfaces) == 0 || slices.Contains(interfaces, "any") {
+		all, err := net.Interfaces()
+		if err != nil {
+			log.Printf("Failed to list interfaces: %v", err)
+		}
+		intfs = all
+	} else {
+		for _, name := range interfaces {
+			intf, err := net.InterfaceByName(name)
+			if err != nil {
+				log.Printf("No interface found named %s", name)
+				continue
+			}
+			intfs = append(intfs, *intf)
+		}
+	}
+
+	for _, intf := range intfs {
+		if intf.Flags&net.FlagLoopback != 0 {
 			continue
 		}
-		if _, alreadySeen := seen[query.RawQuery]; alreadySeen {
+		addrs, err := intf.Addrs()
+		if err != nil {
+			log.Printf("No addrs found for interface %s", intf.Name)
 			continue
 		}
+		for _, addr := range addrs {
+			var ip net.IP
+			switch addr := addr.(type) {
+			case *net.IPNet:
+				ip = addr.IP
+			case *net.IPAddr:
+				ip = addr.IP
+			}
 
-		res = append(res, query)
-		seen[query.RawQuery] = struct{}{}
+			addr := discovery.HostAddress{Addr: ip.String(), Interface: intf.Name}
+			if ip.To4() == nil {
+				ipv6 = append(ipv6, addr)
+			} else {
+				me.Addresses = append(me.Addresses, addr)
+			}
+		}
 	}
-	return res
+	// IPv4 first, like the hosts built from records
+	me.Addresses = append(me.Addresses, ipv6...)
+	return me
 }
 
-func serviceInstancesForHost(host Host) []ServiceInstance {
-	var res []ServiceInstance
-	for _, instance := range serviceInstances {
-		if instance.Host == host.Name {
-			res = append(res, instance)
-		}
-	}
-	return res
+// Throws away everything we have learned about the network.
+func resetState(interfaces []string) {
+	engine.Reset(thisPC(interfaces))
 }
 
 func AfterCreateContext() {
@@ -175,174 +149,31 @@ func AfterCreateContext() {
 		icons[iconInfo.Name()] = loadTexture(iconData)
 	}
 
-	capturePackets()
-}
+	// Our own host depends on the interfaces chosen on the command line.
+	engine.Verbose = true
+	resetState(LiveCaptureConfig().Interfaces)
 
-func capturePackets() {
-	packets, err := packet.CaptureMDNS()
-	if err != nil {
-		panic(fmt.Errorf("Could not start packet capture: %v", err))
+	go processPackets()
+	if CaptureFile != "" {
+		LoadCaptureFiles([]string{CaptureFile})
+	} else if err := startLiveCapture(); err != nil {
+		log.Printf("ERROR: Could not start packet capture: %v", err)
+		liveCaptureError = err
 	}
-	go func() {
-		for p := range packets {
-			// Track queries for PTR records
-			for _, question := range p.DNS.Question {
-				switch question.Qtype {
-				case dns.TypePTR:
-					if !packet.HostMatches(question.Name, "**._tcp.local") && !packet.HostMatches(question.Name, "**._udp.local") {
-						// This PTR question is not looking for DNS-SD services
-						break
-					}
-
-					nameParts := packet.SplitHost(question.Name)
-					serviceQueries = append(serviceQueries, ServiceQuery{
-						SourceAddr:  p.SrcAddr,
-						ServiceType: strings.Join(nameParts[:len(nameParts)-1], "."),
-
-						RawQuery: question.Name,
-					})
-				}
-			}
-
-			// DNS-SD recommends that various records be added to the Additional
-			// section in order to flesh out the services being advertised. This
-			// effectively means that we can just treat whatever we find in the
-			// Additional section as if they were extra answers. (Also, it seems like
-			// sometimes we get them in the Authoritative Nameservers section too?
-			// Who knows, just watch 'em all.)
-			//
-			// https://datatracker.ietf.org/doc/html/rfc6763#section-12
-			//
-			// One quirk worth being aware of is that mDNS queries can contain known
-			// answers in the Answers section. For this project we naively trust them
-			// because it fleshes out our graph and because any incorrect entries
-			// will be overridden by a subsequent answer anyway. (Unless they were
-			// unicasted back I suppose, but there's only so much I can do, all
-			// right?)
-			answers := p.DNS.Answer
-			answers = append(answers, p.DNS.Extra...)
-			answers = append(answers, p.DNS.Ns...)
-			for _, answer := range answers {
-				// In DNS-SD, a PTR record indicates that a service is being
-				// advertised. If a PTR record is provided than it is expected that
-				// a SRV and TXT record will also be provided (although this is
-				// seemingly not guaranteed, from my testing).
-				//
-				// The PTR record itself simply contains a Service Instance Name
-				// (https://datatracker.ietf.org/doc/html/rfc6763#section-4.1). For
-				// example, a PTR record for name "_airplay._tcp.local" may map to
-				// the service instance "MacBook Pro (3)._airplay._tcp.local", where
-				// "MacBook Pro (3)" is the instance, "_airplay._tcp" is the service,
-				// and "local" is the domain.
-				//
-				// The corresponding SRV and TXT records would have the name
-				// "MacBook Pro (3)._airplay._tcp.local". The SRV record tells the
-				// mDNS client what host and port to use for the advertised instance,
-				// for example, "MacBook-Pro-3.local" and port 7000. The TXT record
-				// would provide any additional data about the service, e.g. AirPlay
-				// protocol version.
-				//
-				// https://datatracker.ietf.org/doc/html/rfc6763#section-5
-				//
-				// A PTR record for "_services._dns-sd._udp.local" is used for
-				// enumeration of all available services. These are PTRs to PTRS, and
-				// will not have corresponding SRV and TXT records. For this tool we
-				// will actually just ignore those since they contain no data to
-				// identify a specific instance or host, so they're pretty irrelevant.
-				//
-				// https://datatracker.ietf.org/doc/html/rfc6763#section-9
-
-				switch rr := answer.(type) {
-				case *dns.PTR:
-					log.Printf("Got PTR: %#v", rr)
-					if packet.HostMatches(rr.Hdr.Name, "_services._dns-sd._udp.local") {
-						// Meta-PTR. Ignore, since they contain nothing to identify a
-						// specific instance. We will see the PTRs we care about in other
-						// records.
-						break
-					}
-
-					if !packet.HostMatches(rr.Hdr.Name, "**._tcp.local") && !packet.HostMatches(rr.Hdr.Name, "**._udp.local") {
-						// This PTR is not advertising a service instance.
-						break
-					}
-
-					serviceInstanceName := rr.Ptr
-					snameParts := packet.SplitHost(serviceInstanceName)
-					instance := ServiceInstance{
-						InstanceName: snameParts[0],
-						ServiceType:  strings.Join(snameParts[1:len(snameParts)-1], "."),
-						Domain:       snameParts[len(snameParts)-1], // assuming "local" always per above
-
-						RawName: serviceInstanceName,
-					}
-					utils.AppendToSliceIfAbsent(&serviceInstances, instance, func(i ServiceInstance) string {
-						return i.RawName
-					})
-
-				// SRV and TXT records go into the queue.
-				case *dns.SRV:
-					log.Printf("Got SRV: %#v", rr)
-					if !packet.HostMatches(rr.Hdr.Name, "**._tcp.local") && !packet.HostMatches(rr.Hdr.Name, "**._udp.local") {
-						// This SRV has nothing to do with a service instance.
-						break
-					}
-					utils.AppendToSliceIfAbsent[dns.RR, string](&deferredRRs, rr, func(r dns.RR) string { return r.Header().Name })
-				case *dns.TXT:
-					log.Printf("Got TXT: %#v", rr)
-					if !packet.HostMatches(rr.Hdr.Name, "**._tcp.local") && !packet.HostMatches(rr.Hdr.Name, "**._udp.local") {
-						// This TXT has nothing to do with a service instance.
-						break
-					}
-					utils.AppendToSliceIfAbsent[dns.RR, string](&deferredRRs, rr, func(r dns.RR) string { return r.Header().Name })
-
-				// A and AAAA records get tracked to their corresponding hosts.
-				case *dns.A:
-					log.Printf("Got A: %#v", rr)
-					host := utils.AppendToSliceIfAbsent(&hosts, Host{Name: rr.Hdr.Name}, func(h Host) string { return h.Name })
-					host.IPv4Addr = rr.A.String()
-				case *dns.AAAA:
-					log.Printf("Got AAAA: %#v", rr)
-					host := utils.AppendToSliceIfAbsent(&hosts, Host{Name: rr.Hdr.Name}, func(h Host) string { return h.Name })
-					host.IPv6Addr = rr.AAAA.String()
-				}
-			}
-
-			// Process the queue of SRVs and TXTs. Because we process items in order,
-			// even a stack of old records should resolve quickly to the latest
-			// information.
-			for i := 0; i < len(deferredRRs); i++ {
-				rr := deferredRRs[i]
-				if instance, ok := utils.FindInSlice(serviceInstances, func(i ServiceInstance) bool {
-					return i.RawName == rr.Header().Name
-				}); ok {
-					// We have an instance we can update.
-					switch rr := rr.(type) {
-					case *dns.SRV:
-						instance.Host = rr.Target
-						instance.Port = int(rr.Port)
-					case *dns.TXT:
-						instance.Extras = rr.Txt
-					}
-
-					// Since we processed this record, remove it from the queue.
-					deferredRRs = slices.Delete(deferredRRs, i, i+1)
-					i -= 1
-				} else {
-					// Still no information for this record.
-				}
-			}
-		}
-	}()
 }
 
 func UI() {
+	state := engine.Snapshot()
+	avahiMu.Lock()
+	avahiServices := avahiServices
+	avahiMu.Unlock()
+
 	imgui.ShowDemoWindow()
 
 	imgui.SetNextWindowSizeV(imgui.NewVec2(300, 300), imgui.CondOnce)
 
 	if imgui.Begin("Services") {
-		imgui.BeginTableV("services", 8, imgui.TableFlagsSizingFixedFit|imgui.TableFlagsResizable|imgui.TableFlagsBorders|imgui.TableFlagsRowBg, imgui.NewVec2(0, 0), 0)
+		imgui.BeginTableV("services", 9, imgui.TableFlagsSizingFixedFit|imgui.TableFlagsResizable|imgui.TableFlagsBorders|imgui.TableFlagsRowBg, imgui.NewVec2(0, 0), 0)
 
 		imgui.TableSetupColumn("Interface")
 		imgui.TableSetupColumn("Protocol")
@@ -352,6 +183,7 @@ func UI() {
 		imgui.TableSetupColumn("Hostname")
 		imgui.TableSetupColumn("Address")
 		imgui.TableSetupColumn("Port")
+		imgui.TableSetupColumn("TXT")
 		imgui.TableHeadersRow()
 
 		for _, service := range avahiServices {
@@ -372,6 +204,12 @@ func UI() {
 			imgui.Text(service.Address)
 			imgui.TableNextColumn()
 			imgui.Text(service.Port)
+			imgui.TableNextColumn()
+			var attrs []string
+			for _, attr := range service.TXT.Entries() {
+				attrs = append(attrs, attr.String())
+			}
+			imgui.Text(strings.Join(attrs, " "))
 		}
 		imgui.EndTable()
 
@@ -418,16 +256,24 @@ func UI() {
 
 	if imgui.Begin("Debug") {
 		imgui.Text("Services:")
-		for _, instance := range serviceInstances {
+		for _, instance := range state.ServiceInstances {
 			if imgui.TreeNodeExStr(instance.RawName) {
 				imgui.Text(fmt.Sprintf("Name: %s", instance.InstanceName))
 				imgui.Text(fmt.Sprintf("ServiceType: %s", instance.ServiceType))
 				imgui.Text(fmt.Sprintf("Domain: %s", instance.Domain))
 				imgui.Text(fmt.Sprintf("Host: %s", instance.Host))
 				imgui.Text(fmt.Sprintf("Port: %d", instance.Port))
+				if len(instance.Subtypes) > 0 {
+					imgui.Text(fmt.Sprintf("Subtypes: %s", strings.Join(instance.Subtypes, ", ")))
+				}
+				imgui.Text(fmt.Sprintf("Last seen: %s", formatLastSeen(instance.LastSeen)))
+				imgui.Text(fmt.Sprintf("PTR: %s", formatExpiry(instance.PTR, state.Now)))
+				imgui.Text(fmt.Sprintf("SRV: %s", formatExpiry(instance.SRV, state.Now)))
+				imgui.Text(fmt.Sprintf("TXT: %s", formatExpiry(instance.TXT, state.Now)))
+				recordsUI(instance.Records, dns.TypeSRV, dns.TypeTXT)
 				if imgui.TreeNodeExStrStr("extras", 0, "Extras") {
-					for _, extra := range instance.Extras {
-						imgui.Text(extra)
+					for _, attr := range instance.Attributes.Entries() {
+						imgui.Text(attr.String())
 					}
 					imgui.TreePop()
 				}
@@ -436,15 +282,113 @@ func UI() {
 			}
 		}
 
+		imgui.Text("Service types:")
+		imgui.Indent()
+		for _, group := range utils.GroupIntoSlice(state.ServiceTypes, func(t discovery.AdvertisedServiceType) string { return t.Responder }) {
+			var types []string
+			for _, t := range group.Items {
+				types = append(types, t.ServiceType)
+			}
+			imgui.Text(fmt.Sprintf("%s: %s", group.Key, strings.Join(types, ", ")))
+		}
+		imgui.Unindent()
+
+		imgui.Text("Browse domains:")
+		imgui.Indent()
+		for _, domain := range state.BrowseDomains {
+			imgui.Text(fmt.Sprintf("%s: %s (%s, last seen %s)",
+				domain.Description(), domain.Domain, formatExpiry(domain.PTR, state.Now), formatLastSeen(domain.LastSeen)))
+		}
+		imgui.Unindent()
+
+		imgui.Text("Reverse PTRs:")
+		imgui.Indent()
+		for _, r := range state.ReversePTRs {
+			imgui.Text(fmt.Sprintf("%s -> %s (%s)", r.Addr, r.Host, formatExpiry(r.PTR, state.Now)))
+			for _, conflict := range state.ReverseConflicts(r) {
+				imgui.BulletText(fmt.Sprintf("Mismatch! %s", conflict))
+			}
+		}
+		imgui.Unindent()
+
+		imgui.Text("Devices:")
+		for _, device := range state.Devices {
+			// A single-host device's ID is its host's name, so it needs its
+			// own ID to not clash with the host below.
+			if imgui.TreeNodeExStr(device.ID + "##device") {
+				for _, host := range device.Hosts {
+					imgui.Text(host.Name)
+					if len(device.Hosts) > 1 {
+						imgui.SameLine()
+						imgui.PushIDStr(host.Name)
+						if imgui.SmallButton("Split off") {
+							engine.Split(host.Name)
+						}
+						imgui.PopID()
+					}
+				}
+				for _, reason := range device.Reasons {
+					imgui.BulletText(reason)
+				}
+				imgui.TreePop()
+			}
+		}
+
 		imgui.Text("Hosts:")
-		for _, host := range hosts {
+		for _, host := range state.Hosts {
 			if imgui.TreeNodeExStr(host.Name) {
 				imgui.Text(fmt.Sprintf("Name: %s", host.Name))
-				imgui.Text(fmt.Sprintf("IPv4 Addr: %s", host.IPv4Addr))
-				imgui.Text(fmt.Sprintf("IPv6 Addr: %s", host.IPv6Addr))
-				imgui.Text(fmt.Sprintf("Position: [%f, %f]", host.Pos.X, host.Pos.Y))
+				imgui.Text("Addresses:")
+				imgui.Indent()
+				for _, addr := range host.Addresses {
+					imgui.Text(formatAddress(addr, state.Now))
+				}
+				imgui.Unindent()
+				imgui.Text(fmt.Sprintf("MACs: %s", strings.Join(host.MACs, ", ")))
+				imgui.Text(fmt.Sprintf("Last seen: %s", formatLastSeen(host.LastSeen)))
+				if host.OffLinkTTL != 0 {
+					imgui.Text(fmt.Sprintf("Off-link! Sent with IP TTL %d", host.OffLinkTTL))
+				}
+				if host.Provisional {
+					imgui.Text("Provisional: only seen sending queries")
+				}
+				if host.ProxiedBy != "" {
+					imgui.Text(fmt.Sprintf("Asleep, proxied by %s", host.ProxiedBy))
+					if host.Owner != nil {
+						imgui.Text(fmt.Sprintf("Owner: %s", host.Owner))
+					}
+				}
+				for _, r := range state.ReversePTRsForHost(host) {
+					for _, conflict := range state.ReverseConflicts(r) {
+						imgui.Text(fmt.Sprintf("Mismatch! %s", conflict))
+					}
+				}
+				recordsUI(host.Records, dns.TypeA, dns.TypeAAAA)
+				if host.EDNS != nil {
+					imgui.Text(fmt.Sprintf("EDNS: UDP size %d, last seen %s", host.EDNS.UDPSize, formatLastSeen(host.EDNS.Received)))
+					imgui.Indent()
+					for _, option := range host.EDNS.Options {
+						imgui.Text(option.String())
+					}
+					if owner, ok := host.EDNS.Owner(); ok {
+						imgui.Text(fmt.Sprintf("Owner: %s", owner))
+					}
+					imgui.Unindent()
+				}
+				if node, ok := graphNodes[host.Name]; ok {
+					imgui.Text(fmt.Sprintf("Position: [%f, %f]", node.Pos.X, node.Pos.Y))
+				}
+
+				if unresolved := state.UnresolvedServiceTypesForHost(host); len(unresolved) > 0 {
+					imgui.Text("Advertised but not resolved:")
+					imgui.Indent()
+					for _, t := range unresolved {
+						imgui.Text(niceNameForServiceType(t.ServiceType))
+					}
+					imgui.Unindent()
+				}
 
-				queries := serviceQueriesForHost(host)
+				queries := state.ServiceQueriesForHost(host)
 				if len(queries) > 0 {
 					imgui.Text("Requested services:")
 					imgui.Indent()
@@ -458,13 +402,43 @@ func UI() {
 			}
 		}
 
-		imgui.Text(fmt.Sprintf("%d queued RRs:", len(deferredRRs)))
-		for _, rr := range deferredRRs {
+		// A MAC with several hostnames is usually one device with several
+		// names (or a device and the sleep proxy answering for it).
+		imgui.Text("Hosts by MAC:")
+		type hostMAC struct{ MAC, Host string }
+		var hostMACs []hostMAC
+		for _, host := range state.Hosts {
+			for _, mac := range host.MACs {
+				hostMACs = append(hostMACs, hostMAC{mac, host.Name})
+			}
+		}
+		for _, group := range utils.GroupIntoSlice(hostMACs, func(hm hostMAC) string { return hm.MAC }) {
+			if imgui.TreeNodeExStr(group.Key) {
+				for _, hm := range group.Items {
+					imgui.BulletText(hm.Host)
+				}
+				imgui.TreePop()
+			}
+		}
+
+		if len(state.OffLinkSenders) > 0 {
+			imgui.Text("Off-link senders:")
+			for _, sender := range state.OffLinkSenders {
+				imgui.BulletText(fmt.Sprintf("%s (TTL %d, last seen %s)", sender.Addr, sender.TTL, formatLastSeen(sender.LastSeen)))
+			}
+		}
+
+		imgui.Text(fmt.Sprintf("%d queued RRs:", len(state.DeferredRRs)))
+		for _, rr := range state.DeferredRRs {
 			imgui.BulletText(fmt.Sprintf("%s %s", dns.Type(rr.Header().Rrtype), rr.Header().Name))
 		}
 	}
 	imgui.End()
 
+	captureUI()
+	malformedUI()
+	queriesUI(&state)
+
 	if imgui.Begin("Graph Controls") {
 		imgui.SliderFloatV("Spring Length", &springLength, 0, 500, "%.3f", 0)
 		imgui.SliderFloatV("Spring Strength", &springStrength, 0, 1, "%.3f", 0)
@@ -482,7 +456,7 @@ func UI() {
 		if dt > 100*time.Millisecond {
 			dt = 100 * time.Millisecond
 		}
-		updateGraph(float32(dt.Seconds()))
+		updateGraph(&state, float32(dt.Seconds()))
 		lastFrame = now
 
 		windowPos := imgui.CursorScreenPos()
@@ -491,35 +465,64 @@ func UI() {
 			Add(imgui.NewVec2(renderOffset[0], renderOffset[1]))
 
 		// Render graph nodes
-		for i := range hosts {
-			host := &hosts[i]
-			imgui.SetCursorScreenPos(windowCenter.Add(host.Pos))
-			imgui.BeginChildStr(host.Name)
+		for _, device := range state.Devices {
+			node := graphNodes[device.ID]
+			imgui.SetCursorScreenPos(windowCenter.Add(node.Pos))
+			// Devices fade out as their records go stale
+			freshness := device.Freshness(state.Now)
+			imgui.PushStyleVarFloat(imgui.StyleVarAlpha, fadeAlpha(freshness))
+			imgui.BeginChildStr(device.ID)
 			{
 				imgui.Image(macbook.ID, macbookSize)
-				imgui.Text(host.Name)
-				if host.IPv4Addr != "" {
-					imgui.Text(host.IPv4Addr)
+				for _, host := range device.Hosts {
+					imgui.Text(host.Name)
+				}
+				for _, addr := range device.Addresses() {
+					if addr.Interface != "" {
+						imgui.Text(fmt.Sprintf("%s (%s)", addr.Addr, addr.Interface))
+					} else {
+						imgui.Text(addr.Addr)
+					}
+				}
+				for _, mac := range device.MACs() {
+					imgui.Text(mac)
 				}
-				if host.IPv6Addr != "" {
-					imgui.Text(host.IPv6Addr)
+				for _, host := range device.Hosts {
+					if host.ProxiedBy != "" {
+						imgui.TextDisabled(fmt.Sprintf("Asleep, proxied by %s", host.ProxiedBy))
+					}
+				}
+
+				// Devices we have only seen browsing have no services of their
+				// own, so show what they are looking for instead.
+				if device.Provisional() {
+					imgui.TextDisabled("Looking for:")
+					var seen []string
+					for _, query := range state.ServiceQueriesForDevice(device) {
+						if !slices.Contains(seen, query.ServiceType) {
+							seen = append(seen, query.ServiceType)
+							imgui.TextDisabled(niceNameForServiceType(query.ServiceType))
+						}
+					}
 				}
 
 				// Service icons!
-				host.ServiceIcons = nil
+				node.ServiceIcons = nil
 				numAdditionalInstances := 0
-				for _, service := range serviceInstancesForHost(*host) {
+				for _, service := range state.ServiceInstancesForDevice(device) {
 					if iconName, ok := service2iconname[service.ServiceType]; ok {
-						iconIdx := len(host.ServiceIcons)
+						iconIdx := len(node.ServiceIcons)
 						if iconIdx%5 > 0 {
 							imgui.SameLine()
 						}
 
-						host.ServiceIcons = append(host.ServiceIcons, ServiceIcon{
+						node.ServiceIcons = append(node.ServiceIcons, ServiceIcon{
 							ServiceType: service.ServiceType,
 							Position:    imgui.CursorScreenPos(),
 						})
+						imgui.PushStyleVarFloat(imgui.StyleVarAlpha, fadeAlpha(min(freshness, service.Freshness(state.Now))))
 						imgui.Image(icons[iconName].ID, iconSize)
+						imgui.PopStyleVar()
 						imgui.SetItemTooltip(niceNameForServiceType(service.ServiceType))
 					} else {
 						numAdditionalInstances += 1
@@ -528,21 +531,40 @@ func UI() {
 				if numAdditionalInstances > 0 {
 					imgui.Text(fmt.Sprintf("+%d", numAdditionalInstances))
 				}
+
+				// Services we know are there, but haven't seen the instances of
+				for _, host := range device.Hosts {
+					for _, t := range state.UnresolvedServiceTypesForHost(host) {
+						imgui.TextDisabled(niceNameForServiceType(t.ServiceType))
+					}
+				}
+
+				deviceContextMenu(&state, device)
 			}
 			imgui.EndChild()
+			imgui.PopStyleVar()
 		}
 
 		// Render graph lines
 		dl := imgui.WindowDrawList()
 		lineColor := imgui.ColorU32Vec4(imgui.NewVec4(0.6, 0.6, 0.6, 1))
+		proxyColor := imgui.ColorU32Vec4(imgui.NewVec4(0.4, 0.5, 0.9, 1))
 		for _, edge := range edges {
+			a, b := graphNodes[edge.A.ID], graphNodes[edge.B.ID]
+			if edge.Proxy {
+				from := windowCenter.Add(a.Pos).Add(macbookSize.Mul(0.5))
+				to := windowCenter.Add(b.Pos).Add(macbookSize.Mul(0.5))
+				dl.AddLineV(from, to, proxyColor, 2)
+				dl.AddTextVec2(from.Add(to).Mul(0.5), proxyColor, "proxied by")
+				continue
+			}
 			didDrawDirectlyToOtherDevice := false
-			for _, thisQuery := range serviceQueriesForHost(*edge.A) {
+			for _, thisQuery := range state.ServiceQueriesForDevice(edge.A) {
 				didDrawToIcon := false
-				for _, otherIcon := range edge.B.ServiceIcons {
+				for _, otherIcon := range b.ServiceIcons {
 					if thisQuery.ServiceType == otherIcon.ServiceType {
 						dl.AddLine(
-							windowCenter.Add(edge.A.Pos).Add(macbookSize.Mul(0.5)),
+							windowCenter.Add(a.Pos).Add(macbookSize.Mul(0.5)),
 							otherIcon.Position.Add(iconSize.Mul(0.5)),
 							lineColor,
 						)
@@ -551,8 +573,8 @@ func UI() {
 				}
 				if !didDrawToIcon && !didDrawDirectlyToOtherDevice {
 					dl.AddLine(
-						windowCenter.Add(edge.A.Pos).Add(macbookSize.Mul(0.5)),
-						windowCenter.Add(edge.B.Pos).Add(macbookSize.Mul(0.5)),
+						windowCenter.Add(a.Pos).Add(macbookSize.Mul(0.5)),
+						windowCenter.Add(b.Pos).Add(macbookSize.Mul(0.5)),
 						lineColor,
 					)
 					didDrawDirectlyToOtherDevice = true
@@ -563,6 +585,93 @@ func UI() {
 	imgui.End()
 }
 
+// Lets the user fix up our guesses about which hosts are the same device.
+func deviceContextMenu(state *discovery.State, device discovery.Device) {
+	if !imgui.BeginPopupContextWindow() {
+		return
+	}
+	if imgui.BeginMenu("Merge with") {
+		for _, other := range state.Devices {
+			if other.ID != device.ID && imgui.MenuItemBool(other.ID) {
+				engine.Merge(device.ID, other.ID)
+			}
+		}
+		imgui.EndMenu()
+	}
+	if len(device.Hosts) > 1 && imgui.BeginMenu("Split off") {
+		for _, host := range device.Hosts {
+			if imgui.MenuItemBool(host.Name) {
+				engine.Split(host.Name)
+			}
+		}
+		imgui.EndMenu()
+	}
+	imgui.EndPopup()
+}
+
+// Shows the records we don't otherwise interpret, calling out any of the given
+// types that an NSEC says the name doesn't have.
+func recordsUI(records discovery.RecordSet, types ...uint16) {
+	var lacks []string
+	for _, t := range types {
+		if records.Lacks(t) {
+			lacks = append(lacks, dns.TypeToString[t])
+		}
+	}
+	if len(lacks) > 0 {
+		imgui.Text(fmt.Sprintf("Explicitly has no %s", strings.Join(lacks, " or ")))
+	}
+	if nsec, ok := records.NSEC(); ok {
+		var has []string
+		for _, t := range nsec.TypeBitMap {
+			has = append(has, dns.TypeToString[t])
+		}
+		imgui.Text(fmt.Sprintf("NSEC: only has %s", strings.Join(has, ", ")))
+	}
+	if hinfo, ok := records.HINFO(); ok {
+		imgui.Text(fmt.Sprintf("HINFO: CPU %q, OS %q", hinfo.Cpu, hinfo.Os))
+	}
+	for _, r := range records.Other() {
+		imgui.Text(r.RR.String())
+	}
+}
+
+// Stale things are drawn faded out, but never so much that they disappear
+// before they are actually removed.
+func fadeAlpha(freshness float64) float32 {
+	return float32(0.2 + 0.8*freshness)
+}
+
+// Describes when a record expires, relative to now.
+func formatExpiry(r discovery.CachedRecord, now time.Time) string {
+	if r.RR == nil {
+		return "none"
+	}
+	return fmt.Sprintf("TTL %d, expires in %s", r.RR.Header().Ttl, r.Expires.Sub(now).Round(time.Second))
+}
+
+func formatAddress(a discovery.HostAddress, now time.Time) string {
+	res := a.Addr
+	if a.Interface != "" {
+		res += fmt.Sprintf(" on %s", a.Interface)
+	}
+	if a.Reverse {
+		res += " (reverse PTR only)"
+	}
+	if a.Expires.IsZero() {
+		return res
+	}
+	return fmt.Sprintf("%s: TTL %d, expires in %s, last seen %s",
+		res, a.TTL, a.Expires.Sub(now).Round(time.Second), formatLastSeen(a.LastSeen))
+}
+
+func formatLastSeen(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("15:04:05.000")
+}
+
 func InputTextCallback(data imgui.InputTextCallbackData) int {
 	fmt.Println("got callback")
 	return 0
@@ -587,31 +696,58 @@ var (
 
 	edges        []GraphEdge
 	renderOffset = [2]float32{-40, -45}
+
+	// The graph layout belongs to the UI, not the discovery state, so nodes
+	// are kept separately and keyed by device ID.
+	graphNodes = make(map[string]*GraphNode)
 )
 
+type GraphNode struct {
+	Pos, Vel     imgui.Vec2
+	ServiceIcons []ServiceIcon
+}
+
+type ServiceIcon struct {
+	ServiceType string
+	Position    imgui.Vec2
+}
+
 type GraphEdge struct {
-	A, B *Host
+	A, B discovery.Device
+	// A is asleep, and B is the sleep proxy answering for it, rather than A
+	// looking for B's services.
+	Proxy bool
 }
 
-func hostsConnected(a, b *Host) bool {
+func devicesConnected(a, b string) bool {
 	for _, edge := range edges {
-		if (edge.A == a && edge.B == b) || (edge.A == b && edge.B == a) {
+		if (edge.A.ID == a && edge.B.ID == b) || (edge.A.ID == b && edge.B.ID == a) {
 			return true
 		}
 	}
 	return false
 }
 
-func updateGraph(dt float32) {
+func updateGraph(state *discovery.State, dt float32) {
+	// Sync nodes with the current devices
+	for id := range graphNodes {
+		if !slices.ContainsFunc(state.Devices, func(d discovery.Device) bool { return d.ID == id }) {
+			delete(graphNodes, id)
+		}
+	}
+	for _, device := range state.Devices {
+		if _, ok := graphNodes[device.ID]; !ok {
+			graphNodes[device.ID] = &GraphNode{}
+		}
+	}
+
 	// Calculate edges
 	edges = nil
-	for i := range hosts {
-		for j := range hosts {
-			a, b := &hosts[i], &hosts[j]
-
+	for _, a := range state.Devices {
+		for _, b := range state.Devices {
 			connected := false
-			aQueries := serviceQueriesForHost(*a)
-			bServices := serviceInstancesForHost(*b)
+			aQueries := state.ServiceQueriesForDevice(a)
+			bServices := state.ServiceInstancesForDevice(b)
 		checkConnection:
 			for _, query := range aQueries {
 				for _, instance := range bServices {
@@ -627,27 +763,32 @@ func updateGraph(dt float32) {
 			}
 		}
 	}
+	for _, a := range state.Devices {
+		for _, host := range a.Hosts {
+			b, ok := state.SleepProxyDevice(host)
+			if ok && b.ID != a.ID && !slices.ContainsFunc(edges, func(e GraphEdge) bool { return e.Proxy && e.A.ID == a.ID && e.B.ID == b.ID }) {
+				edges = append(edges, GraphEdge{A: a, B: b, Proxy: true})
+			}
+		}
+	}
 
-	for i := range hosts {
-		host := &hosts[i]
-
+	for _, node := range graphNodes {
 		// Jitter to ensure force directed stuff has something to work with
-		if host.Pos.X == 0 && host.Pos.Y == 0 {
-			host.Pos = imgui.NewVec2(
+		if node.Pos.X == 0 && node.Pos.Y == 0 {
+			node.Pos = imgui.NewVec2(
 				newNodeJitter*2*rand.Float32()-newNodeJitter, newNodeJitter*2*rand.Float32()-newNodeJitter,
 			)
 		}
 
 		// Gravity
-		toOrigin := host.Pos.Mul(-1)
-		host.Vel.X += gravityStrength * toOrigin.X
-		host.Vel.Y += gravityStrength * toOrigin.Y
+		toOrigin := node.Pos.Mul(-1)
+		node.Vel.X += gravityStrength * toOrigin.X
+		node.Vel.Y += gravityStrength * toOrigin.Y
 	}
 
 	// Repulsion & attraction
-	for i := range hosts {
-		for j := range hosts {
-			a, b := &hosts[i], &hosts[j]
+	for aName, a := range graphNodes {
+		for bName, b := range graphNodes {
 			dx := a.Pos.X - b.Pos.X
 			dy := a.Pos.Y - b.Pos.Y
 			dist2 := dx*dx + dy*dy
@@ -663,7 +804,7 @@ func updateGraph(dt float32) {
 			}
 
 			// Attraction
-			if hostsConnected(a, b) {
+			if devicesConnected(aName, bName) {
 				force := springStrength * (springLength - d)
 				fx := force * (dx / (d + 0.01))
 				fy := force * (dy / (d + 0.01))
@@ -674,15 +815,13 @@ func updateGraph(dt float32) {
 	}
 
 	// Integrate
-	for i := range hosts {
-		host := &hosts[i]
-
+	for _, node := range graphNodes {
 		// Update velocity (damping + clamping)
-		host.Vel = host.Vel.Mul(1 - damping)
-		host.Vel.X = utils.Clamp(host.Vel.X, -maxVelocity, maxVelocity)
+		node.Vel = node.Vel.Mul(1 - damping)
+		node.Vel.X = utils.Clamp(node.Vel.X, -maxVelocity, maxVelocity)
 
-		host.Pos.X += host.Vel.X * dt
-		host.Pos.Y += host.Vel.Y * dt
+		node.Pos.X += node.Vel.X * dt
+		node.Pos.Y += node.Vel.Y * dt
 	}
 }
 